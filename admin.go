@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/docker/go-connections/sockets"
+	"github.com/docker/go-plugins-helpers/sdk"
+	"github.com/docker/go-plugins-helpers/volume"
+	flag "github.com/ogier/pflag"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+const (
+	DefaultAdminSocket = "/var/run/docker-volume-profitbricks.sock"
+
+	adminSnapshotPath = "/Admin.Snapshot"
+	adminRestorePath  = "/Admin.Restore"
+	adminResizePath   = "/Admin.Resize"
+)
+
+// AdminRequest is sent to the admin socket by the command line client.
+type AdminRequest struct {
+	Name    string
+	Options map[string]string `json:"Opts,omitempty"`
+}
+
+// AdminResponse is returned by the admin socket.
+type AdminResponse struct {
+	Err      string
+	Snapshot *SnapshotRecord `json:",omitempty"`
+	Volume   *volume.Volume  `json:",omitempty"`
+}
+
+// adminCommands maps the subcommands of the binary to the admin endpoint
+// they call and the options their positional arguments are passed as. The
+// first required arguments must be given, the others are optional.
+var adminCommands = map[string]struct {
+	path     string
+	usage    string
+	args     []string
+	required int
+}{
+	"snapshot": {adminSnapshotPath, "snapshot VOLUME [SNAPSHOT-NAME]", []string{"name"}, 0},
+	"restore":  {adminRestorePath, "restore VOLUME SNAPSHOT", []string{"snapshot"}, 1},
+	"resize":   {adminResizePath, "resize VOLUME SIZE-IN-GB", []string{"size"}, 1},
+}
+
+// ListenAdmin creates the admin socket, which is only accessible by root.
+func ListenAdmin(socket string) (net.Listener, error) {
+	return sockets.NewUnixSocket(socket, 0)
+}
+
+// ServeAdmin serves the operations that are not part of the Docker volume
+// protocol on the admin socket until the listener is closed.
+func ServeAdmin(d *Driver, l net.Listener) error {
+	h := sdk.NewHandler("{}")
+
+	h.HandleFunc(adminSnapshotPath, func(w http.ResponseWriter, r *http.Request) {
+		req := AdminRequest{}
+		if err := sdk.DecodeRequest(w, r, &req); err != nil {
+			return
+		}
+		snapshot, err := d.Snapshot(req.Name, req.Options["name"])
+		writeAdminResponse(w, AdminResponse{Snapshot: snapshot}, err)
+	})
+
+	h.HandleFunc(adminRestorePath, func(w http.ResponseWriter, r *http.Request) {
+		req := AdminRequest{}
+		if err := sdk.DecodeRequest(w, r, &req); err != nil {
+			return
+		}
+		state, err := d.Restore(req.Name, req.Options["snapshot"])
+		writeAdminResponse(w, AdminResponse{Volume: adminVolume(state)}, err)
+	})
+
+	h.HandleFunc(adminResizePath, func(w http.ResponseWriter, r *http.Request) {
+		req := AdminRequest{}
+		if err := sdk.DecodeRequest(w, r, &req); err != nil {
+			return
+		}
+		size, err := strconv.Atoi(req.Options["size"])
+		if err != nil || size <= 0 {
+			writeAdminResponse(w, AdminResponse{}, fmt.Errorf("invalid size %q, expected a positive number of GB", req.Options["size"]))
+			return
+		}
+		state, err := d.Resize(req.Name, size)
+		writeAdminResponse(w, AdminResponse{Volume: adminVolume(state)}, err)
+	})
+
+	return h.Serve(l)
+}
+
+func writeAdminResponse(w http.ResponseWriter, res AdminResponse, err error) {
+	if err != nil {
+		res.Err = err.Error()
+	}
+	sdk.EncodeResponse(w, res, res.Err)
+}
+
+func adminVolume(state *VolumeState) *volume.Volume {
+	if state == nil {
+		return nil
+	}
+	return &volume.Volume{
+		Name:       state.Name,
+		Mountpoint: state.MountPoint,
+		Status:     state.status(),
+	}
+}
+
+func isAdminCommand(name string) bool {
+	_, ok := adminCommands[name]
+	return ok
+}
+
+// runAdminCommand sends a subcommand of the binary to the admin socket of
+// the running plugin and prints the result.
+func runAdminCommand(args []string) error {
+	command := adminCommands[args[0]]
+
+	flags := flag.NewFlagSet(args[0], flag.ExitOnError)
+	socket := flags.String("admin-socket", DefaultAdminSocket, "the admin socket of the running plugin")
+	flags.Parse(args[1:])
+
+	if flags.NArg() < command.required+1 || flags.NArg() > len(command.args)+1 {
+		return fmt.Errorf("usage: %s %s", os.Args[0], command.usage)
+	}
+
+	req := AdminRequest{Name: flags.Arg(0), Options: map[string]string{}}
+	for i, value := range flags.Args()[1:] {
+		req.Options[command.args[i]] = value
+	}
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", *socket)
+		},
+	}}
+
+	resp, err := client.Post("http://admin"+command.path, sdk.DefaultContentTypeV1_1, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to reach the plugin on '%v': %v", *socket, err)
+	}
+	defer resp.Body.Close()
+
+	res := AdminResponse{}
+	err = json.NewDecoder(resp.Body).Decode(&res)
+	if err != nil {
+		return err
+	}
+	if res.Err != "" {
+		return fmt.Errorf("%s", res.Err)
+	}
+
+	output, err := json.MarshalIndent(res, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(output))
+	return nil
+}
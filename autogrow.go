@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"time"
+)
+
+const (
+	DefaultGrowThreshold = 90
+	DefaultGrowStep      = 10
+	DefaultGrowInterval  = time.Minute
+)
+
+// AutogrowMonitor watches the filesystem usage of mounted volumes that have
+// a max_size and grows them once the usage crosses their threshold.
+type AutogrowMonitor struct {
+	driver    *Driver
+	threshold int
+	step      int
+	interval  time.Duration
+}
+
+type growCandidate struct {
+	name       string
+	mountPoint string
+	size       int
+	maxSize    int
+	threshold  int
+	step       int
+}
+
+func NewAutogrowMonitor(driver *Driver, threshold int, step int, interval time.Duration) *AutogrowMonitor {
+	return &AutogrowMonitor{
+		driver:    driver,
+		threshold: threshold,
+		step:      step,
+		interval:  interval,
+	}
+}
+
+func (a *AutogrowMonitor) Run() {
+	for {
+		for _, c := range a.candidates() {
+			a.check(c)
+		}
+		time.Sleep(a.interval)
+	}
+}
+
+// candidates returns the mounted volumes that can still grow, with the
+// volume's own threshold and step taking precedence over the defaults.
+func (a *AutogrowMonitor) candidates() []growCandidate {
+	d := a.driver
+
+	candidates := []growCandidate{}
+	for _, name := range d.volumeNames() {
+		c, ok := a.candidate(name)
+		if ok {
+			candidates = append(candidates, c)
+		}
+	}
+	return candidates
+}
+
+func (a *AutogrowMonitor) candidate(name string) (growCandidate, bool) {
+	d := a.driver
+	defer d.locks.lock(name)()
+
+	state, ok := d.lookupVolume(name)
+	if !ok {
+		return growCandidate{}, false
+	}
+
+	opts := state.Options
+	if opts.MaxSize <= opts.Size || state.Status != VolumeStatusReady {
+		return growCandidate{}, false
+	}
+
+	mounted, err := d.utilities.IsMounted(state.MountPoint)
+	if err != nil {
+		log.Errorf("volume '%v': %v", name, err)
+		return growCandidate{}, false
+	}
+	if !mounted {
+		return growCandidate{}, false
+	}
+
+	c := growCandidate{
+		name:       name,
+		mountPoint: state.MountPoint,
+		size:       opts.Size,
+		maxSize:    opts.MaxSize,
+		threshold:  a.threshold,
+		step:       a.step,
+	}
+	if opts.GrowThreshold != 0 {
+		c.threshold = opts.GrowThreshold
+	}
+	if opts.GrowStep != 0 {
+		c.step = opts.GrowStep
+	}
+	return c, true
+}
+
+func (a *AutogrowMonitor) check(c growCandidate) {
+	usage, err := a.driver.utilities.FilesystemUsage(c.mountPoint)
+	if err != nil {
+		log.Errorf("failed to get the filesystem usage of volume '%v': %v", c.name, err)
+		return
+	}
+	if usage < c.threshold {
+		return
+	}
+
+	size := c.size + c.step
+	if size > c.maxSize {
+		size = c.maxSize
+	}
+
+	log.Warnf("volume '%v' is %d%% full, growing it from %d GB to %d GB", c.name, usage, c.size, size)
+
+	err = a.driver.grow(c.name, c.size, size, c.threshold)
+	if err != nil {
+		log.Errorf("failed to grow volume '%v': %v", c.name, err)
+	}
+}
+
+// grow resizes the volume unless it changed since it was checked: its size
+// must be the same, and it must still be mounted and filled beyond the
+// threshold. The usage of a mount point that is no longer mounted would be
+// the usage of the filesystem below it.
+func (d *Driver) grow(name string, fromSize int, toSize int, threshold int) error {
+	defer d.locks.lock(name)()
+
+	state, ok := d.lookupVolume(name)
+	if !ok {
+		return fmt.Errorf("Volume %q does not exist", name)
+	}
+	if state.Options.Size != fromSize || state.Status != VolumeStatusReady {
+		return nil
+	}
+
+	mounted, err := d.utilities.IsMounted(state.MountPoint)
+	if err != nil || !mounted {
+		return err
+	}
+	usage, err := d.utilities.FilesystemUsage(state.MountPoint)
+	if err != nil || usage < threshold {
+		return err
+	}
+
+	return d.resizeVolume(state, toSize, "autogrow")
+}
@@ -0,0 +1,79 @@
+// Command fake-profitbricks serves a fake of the ProfitBricks Cloud API for
+// running the volume plugin end to end without credentials. Start the
+// plugin with --profitbricks-endpoint http://<listen>/cloudapi/v3.
+package main
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/denza/docker-volume-profitbricks/fakecloud"
+	flag "github.com/ogier/pflag"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+func main() {
+	listen := flag.String("listen", "127.0.0.1:8080", "the address to serve the fake API on")
+	datacenterId := flag.String("datacenter", "00000000-0000-0000-0000-000000000001", "the ID of the datacenter to create")
+	serverIds := flag.String("servers", "", "comma separated IDs of the servers to create, defaults to the ID of this machine")
+	images := flag.String("images", "", "comma separated ID:NAME:SIZE of the images to create")
+	faults := flag.String("faults", "", "comma separated METHOD:PATH:STATUS[:TIMES] faults to inject, STATUS is an HTTP status or FAILED")
+	latency := flag.Duration("latency", 0, "the delay of every response")
+	queueTime := flag.Duration("queue-time", 0, "how long requests stay QUEUED")
+	runTime := flag.Duration("run-time", 0, "how long requests stay RUNNING")
+	flag.Parse()
+
+	server := fakecloud.NewServer(fakecloud.Config{
+		Latency:   *latency,
+		QueueTime: *queueTime,
+		RunTime:   *runTime,
+	})
+	server.AddDatacenter(*datacenterId)
+
+	if *serverIds == "" {
+		// the plugin identifies its server by the DMI product UUID
+		uuid, err := ioutil.ReadFile("/sys/devices/virtual/dmi/id/product_uuid")
+		if err != nil {
+			log.Fatalf("failed to read the ID of this machine, pass --servers: %v", err)
+		}
+		*serverIds = strings.TrimSpace(string(uuid))
+	}
+	for _, id := range strings.Split(*serverIds, ",") {
+		server.AddServer(*datacenterId, strings.TrimSpace(id))
+	}
+
+	for _, spec := range split(*images) {
+		fields := strings.Split(spec, ":")
+		if len(fields) != 3 {
+			log.Fatalf("invalid image %q, expected ID:NAME:SIZE", spec)
+		}
+		size, err := strconv.Atoi(fields[2])
+		if err != nil {
+			log.Fatalf("invalid size in image %q: %v", spec, err)
+		}
+		server.AddImage(fields[0], fields[1], size)
+	}
+
+	for _, spec := range split(*faults) {
+		fault, err := fakecloud.ParseFault(spec)
+		if err != nil {
+			log.Fatal(err)
+		}
+		server.Inject(fault)
+	}
+
+	fmt.Printf("serving the fake ProfitBricks API on http://%v%v\n", *listen, fakecloud.BasePath)
+	log.Fatal(http.ListenAndServe(*listen, server))
+}
+
+func split(list string) []string {
+	items := []string{}
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DeviceWaitTimeout  = 2 * time.Minute
+	DevicePollInterval = time.Second
+	DiskByIdPath       = "/dev/disk/by-id"
+
+	// virtio-blk truncates the disk serial to 20 characters
+	virtioSerialLength = 20
+)
+
+// SysBlockPath is where the kernel lists the block devices. It is a
+// variable so that tests can point it at a directory of their own.
+var SysBlockPath = "/sys/block"
+
+// ResolveDevice waits until the kernel device of the attached ProfitBricks
+// volume shows up and returns its path. The device is looked up by the
+// volume's serial, either through /dev/disk/by-id or the serial exposed in
+// sysfs, and falls back to the device number reported by the API for
+// virtio volumes. The device is verified before it is returned.
+func (m Utilities) ResolveDevice(volumeId string, deviceNumber int64, bus string, sizeGB int, timeout time.Duration) (string, error) {
+	deadline := time.Now().Add(timeout)
+	var lastErr error
+
+	for {
+		device, err := m.findDevice(volumeId, deviceNumber, bus)
+		if err == nil {
+			err = m.VerifyDevice(device, volumeId, sizeGB)
+			if err == nil {
+				return device, nil
+			}
+		}
+		lastErr = err
+
+		if time.Now().After(deadline) {
+			return "", fmt.Errorf("no device found for volume '%v' after %v: %v", volumeId, timeout, lastErr)
+		}
+		time.Sleep(DevicePollInterval)
+	}
+}
+
+func (m Utilities) findDevice(volumeId string, deviceNumber int64, bus string) (string, error) {
+	serial := volumeSerial(volumeId)
+
+	links, _ := filepath.Glob(filepath.Join(DiskByIdPath, "*"+serial+"*"))
+	for _, link := range links {
+		if strings.Contains(filepath.Base(link), "-part") {
+			continue
+		}
+		device, err := filepath.EvalSymlinks(link)
+		if err == nil {
+			return device, nil
+		}
+	}
+
+	disks, err := ioutil.ReadDir(SysBlockPath)
+	if err != nil {
+		return "", err
+	}
+	for _, disk := range disks {
+		if diskSerial(disk.Name()) == serial {
+			return filepath.Join("/dev", disk.Name()), nil
+		}
+	}
+
+	device, err := deviceNameFromNumber(deviceNumber, bus)
+	if err != nil {
+		return "", fmt.Errorf("no device with serial '%v' found and %v", serial, err)
+	}
+	name := filepath.Base(device)
+	if _, err := os.Stat(filepath.Join(SysBlockPath, name)); err != nil {
+		return "", fmt.Errorf("device '%v' for device number %d does not exist yet", name, deviceNumber)
+	}
+	return filepath.Join("/dev", name), nil
+}
+
+// ResolveMountedDevice returns the device mounted on the mount point after
+// making sure it is the device of the volume, looked up like ResolveDevice
+// does. Device names change when a volume is attached again or the host
+// reboots, so the name recorded for a volume is never used on its own.
+func (m Utilities) ResolveMountedDevice(volumeId string, deviceNumber int64, bus string, mountPoint string) (string, error) {
+	device, err := m.findDevice(volumeId, deviceNumber, bus)
+	if err != nil {
+		return "", err
+	}
+	return checkMountedDevice(device, volumeId, mountPoint)
+}
+
+// checkMountedDevice returns the device of the volume if it is the one
+// mounted on the mount point.
+func checkMountedDevice(device string, volumeId string, mountPoint string) (string, error) {
+	mounts, err := ioutil.ReadFile("/proc/mounts")
+	if err != nil {
+		return "", err
+	}
+
+	// the last mount on the mount point hides the ones below it
+	mounted := ""
+	for _, line := range strings.Split(string(mounts), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 1 && fields[1] == mountPoint {
+			mounted = fields[0]
+		}
+	}
+	if mounted == "" {
+		return "", fmt.Errorf("nothing is mounted on '%v'", mountPoint)
+	}
+
+	if resolvePath(mounted) != resolvePath(device) {
+		return "", fmt.Errorf("device '%v' mounted on '%v' is not the device '%v' of volume '%v'", mounted, mountPoint, device, volumeId)
+	}
+	return device, nil
+}
+
+// resolvePath follows the symlinks of a device path, like the ones under
+// /dev/disk or /dev/mapper.
+func resolvePath(path string) string {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return path
+	}
+	return resolved
+}
+
+// VerifyDevice makes sure the device belongs to the given volume and is
+// safe to use: it must be a block device of at least the expected size,
+// as a resize may have completed after the driver stopped waiting, carry the
+// volume's serial if it has one, have no partitions or holders and must
+// not be mounted.
+func (m Utilities) VerifyDevice(device string, volumeId string, sizeGB int) error {
+	info, err := os.Stat(device)
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeDevice == 0 {
+		return fmt.Errorf("'%v' is not a block device", device)
+	}
+
+	name := filepath.Base(device)
+
+	if serial := diskSerial(name); serial != "" && serial != volumeSerial(volumeId) {
+		return fmt.Errorf("device '%v' has serial '%v' which does not belong to volume '%v'", device, serial, volumeId)
+	}
+
+	if sizeGB > 0 {
+		size, err := deviceSize(name)
+		if err != nil {
+			return err
+		}
+		if expected := int64(sizeGB) << 30; size < expected {
+			return fmt.Errorf("device '%v' has %d bytes, expected at least %d", device, size, expected)
+		}
+	}
+
+	partitions, _ := filepath.Glob(filepath.Join(SysBlockPath, name, name+"*"))
+	if len(partitions) > 0 {
+		return fmt.Errorf("device '%v' has partitions", device)
+	}
+
+	holders, _ := ioutil.ReadDir(filepath.Join(SysBlockPath, name, "holders"))
+	if len(holders) > 0 {
+		return fmt.Errorf("device '%v' is held by '%v'", device, holders[0].Name())
+	}
+
+	mounts, err := ioutil.ReadFile("/proc/mounts")
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(string(mounts), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 1 && fields[0] == device {
+			return fmt.Errorf("device '%v' is mounted on '%v'", device, fields[1])
+		}
+	}
+
+	return nil
+}
+
+// RescanDevice asks the kernel to re-read the capacity of a resized device
+// and waits until the device reports at least the given size.
+func (m Utilities) RescanDevice(device string, sizeGB int, timeout time.Duration) error {
+	name := filepath.Base(device)
+
+	// virtio disks pick up the new capacity on their own, SCSI disks have
+	// to be told to rescan
+	rescan := filepath.Join(SysBlockPath, name, "device", "rescan")
+	if _, err := os.Stat(rescan); err == nil {
+		err = ioutil.WriteFile(rescan, []byte("1"), 0200)
+		if err != nil {
+			return fmt.Errorf("failed to rescan '%v': %v", device, err)
+		}
+	}
+
+	deadline := time.Now().Add(timeout)
+	expected := int64(sizeGB) << 30
+	for {
+		size, err := deviceSize(name)
+		if err != nil {
+			return err
+		}
+		if size >= expected {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("device '%v' still has %d bytes after %v, expected %d", device, size, timeout, expected)
+		}
+		time.Sleep(DevicePollInterval)
+	}
+}
+
+// DeviceSize returns the size of the device in GB.
+func (m Utilities) DeviceSize(device string) (int, error) {
+	size, err := deviceSize(filepath.Base(device))
+	if err != nil {
+		return 0, err
+	}
+	return int(size >> 30), nil
+}
+
+func deviceSize(name string) (int64, error) {
+	data, err := ioutil.ReadFile(filepath.Join(SysBlockPath, name, "size"))
+	if err != nil {
+		return 0, err
+	}
+	sectors, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return sectors * 512, nil
+}
+
+// deviceNameFromNumber maps the device number reported by the API to the
+// virtio device the kernel creates for it. IDE disks are named in the
+// order the kernel finds them, which does not follow the device number.
+func deviceNameFromNumber(deviceNumber int64, bus string) (string, error) {
+	if bus != "" && !strings.EqualFold(bus, "VIRTIO") {
+		return "", fmt.Errorf("the device name of a %v volume cannot be derived from its device number", bus)
+	}
+	if deviceNumber < 1 || deviceNumber > 26 {
+		return "", fmt.Errorf("device number %d is unknown", deviceNumber)
+	}
+	return fmt.Sprintf("/dev/vd%c", 'a'+deviceNumber-1), nil
+}
+
+func volumeSerial(volumeId string) string {
+	if len(volumeId) > virtioSerialLength {
+		return volumeId[:virtioSerialLength]
+	}
+	return volumeId
+}
+
+func diskSerial(name string) string {
+	data, err := ioutil.ReadFile(filepath.Join(SysBlockPath, name, "serial"))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
@@ -1,12 +1,13 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/docker/go-plugins-helpers/volume"
-	"github.com/profitbricks/profitbricks-sdk-go"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 )
@@ -15,6 +16,7 @@ const (
 	MetadataDirMode  = 0700
 	MetadataFileMode = 0600
 	MountDirMode     = os.ModeDir
+	VolumeNamePrefix = "docker-volume-profitbricks:"
 )
 
 type Driver struct {
@@ -26,22 +28,36 @@ type Driver struct {
 	serverId     string
 	size         int
 	diskType     string
-	utilities    *Utilities
+	provider     BlockStorageProvider
+	utilities    HostUtilities
+	journal      *Journal
+	mountWait    time.Duration
+	pool         *VolumePool
+
+	// ctx bounds the waits for the cloud; it is canceled when the plugin
+	// shuts down
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// m guards the volumes map and is only held while the map is accessed.
+	// A record may only be changed while holding the lock of its volume;
+	// its name and mount point never change once it is registered.
 	m            *sync.Mutex
+	locks        *volumeLocks
 	volumes      map[string]*VolumeState
+	provisioning map[string]chan struct{}
 }
 
-type VolumeState struct {
-	volumeId   string
-	mountPoint string
-	deviceName string
-}
-
-func ProfitBricksDriver(utilities *Utilities, args CommandLineArgs) (*Driver, error) {
+func ProfitBricksDriver(provider BlockStorageProvider, utilities HostUtilities, args CommandLineArgs) (*Driver, error) {
 
-	profitbricks.SetAuth(*args.profitbricksUsername, *args.profitbricksPassword)
+	// the default disk type is spelled like the type option of a volume,
+	// so that the two compare equal
+	diskType, err := oneOf("profitbricks-disk-type", *args.diskType, diskTypes)
+	if err != nil {
+		return nil, err
+	}
 
-	err := os.MkdirAll(*args.metadataPath, MetadataDirMode)
+	err = os.MkdirAll(*args.metadataPath, MetadataDirMode)
 	if err != nil {
 		return nil, err
 	}
@@ -57,168 +73,507 @@ func ProfitBricksDriver(utilities *Utilities, args CommandLineArgs) (*Driver, er
 		log.Error(err)
 		return nil, err
 	}
-	return &Driver{
+
+	volumes, err := loadVolumeStates(*args.metadataPath)
+	if err != nil {
+		log.Errorf("failed to load volume metadata from '%v': %v", *args.metadataPath, err)
+		return nil, err
+	}
+	log.Infof("loaded %d volume(s) from '%v'", len(volumes), *args.metadataPath)
+
+	journal, err := NewJournal(*args.metadataPath)
+	if err != nil {
+		log.Errorf("failed to open the journal under '%v': %v", *args.metadataPath, err)
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &Driver{
+		ctx:          ctx,
+		cancel:       cancel,
 		datacenterId: *args.datacenterId,
 		serverId:     serverId,
 		size:         *args.size,
-		diskType:     *args.diskType,
-		volumes:      make(map[string]*VolumeState),
+		diskType:     diskType,
+		volumes:      volumes,
 		metadataPath: *args.metadataPath,
+		mountPath:    *args.mountPath,
+		provider:     provider,
 		utilities:    utilities,
-	}, nil
+		journal:      journal,
+		mountWait:    *args.mountWait,
+		m:            &sync.Mutex{},
+		locks:        newVolumeLocks(),
+		provisioning: make(map[string]chan struct{}),
+	}
 
-}
+	if *args.poolSize > 0 {
+		profiles, err := ParsePoolProfiles(*args.poolProfiles)
+		if err != nil {
+			return nil, err
+		}
+		if len(profiles) == 0 {
+			profiles = []PoolProfile{{Size: d.size, DiskType: d.diskType, Filesystem: DefaultFilesystem}}
+		}
+		d.pool = NewVolumePool(d, *args.poolSize, profiles, *args.poolCleanup)
+	}
 
-func (d *Driver) Create(r volume.Request) volume.Response {
-	d.m.Lock()
-	defer d.m.Unlock()
+	creates := d.replayJournal()
+	d.dropStaleMounts()
 
-	vol := profitbricks.Volume{
-		Properties: profitbricks.VolumeProperties{
-			Size:        d.size,
-			Type:        d.diskType,
-			LicenceType: "OTHER",
-			Name:        fmt.Sprintf("docker-volume-profitbricks:%s", r.Name),
-		},
+	err = d.reconcile()
+	if err != nil {
+		log.Errorf("failed to reconcile volumes with the ProfitBricks API: %v", err)
 	}
-	vol = profitbricks.CreateVolume(d.datacenterId, vol)
+	d.replayCreates(creates)
+
+	return d, nil
 
-	err := d.waitTillProvisioned(vol.Headers.Get("Location"))
+}
 
+func (d *Driver) Create(r volume.Request) volume.Response {
+	defer d.locks.lock(r.Name)()
+
+	opts, err := ParseVolumeOptions(r.Options, VolumeOptions{
+		Size:        d.size,
+		DiskType:    d.diskType,
+		LicenceType: "OTHER",
+		Filesystem:  DefaultFilesystem,
+	})
 	if err != nil {
+		log.Errorf("invalid options for volume '%v': %v", r.Name, err)
+		return volume.Response{Err: err.Error()}
+	}
+
+	state, ok := d.lookupVolume(r.Name)
+	if !ok && d.isProvisioning(r.Name) {
+		err = fmt.Errorf("Volume %q is still being rolled back after an interrupted create, try again later", r.Name)
 		log.Error(err.Error())
 		return volume.Response{Err: err.Error()}
 	}
+	if !ok {
+		vol, attached, err := d.findExistingVolume(r.Name)
+		if err != nil {
+			log.Errorf("failed to look up existing cloud volume for '%v': %v", r.Name, err)
+			return volume.Response{Err: err.Error()}
+		}
+		if vol != nil {
+			adopted, err := adoptedOptions(*vol, "", r.Options, opts)
+			if err == nil {
+				err = d.beginProvisioning(r.Name, vol.Id, adopted, "")
+			}
+			if err != nil {
+				log.Errorf("failed to adopt existing cloud volume for '%v': %v", r.Name, err)
+				return volume.Response{Err: err.Error()}
+			}
+			go d.adopt(r.Name, *vol, attached, r.Options, opts)
+
+			log.Infof("adopting cloud volume '%v' for volume '%v' in the background", vol.Id, r.Name)
+			return volume.Response{}
+		}
+	}
+
+	if state != nil {
+		if state.Status == VolumeStatusMissing {
+			err = fmt.Errorf("Volume %q exists but its cloud volume '%v' is missing", r.Name, state.VolumeId)
+			log.Error(err.Error())
+			return volume.Response{Err: err.Error()}
+		}
+		if state.Status == VolumeStatusFailed {
+			err = fmt.Errorf("%v, remove it before creating it again", state.checkProvisioned())
+			log.Error(err.Error())
+			return volume.Response{Err: err.Error()}
+		}
+		if conflicts := state.Options.Conflicts(r.Options, opts); len(conflicts) > 0 {
+			err = fmt.Errorf("Volume %q already exists with different values for %v", r.Name, strings.Join(conflicts, ", "))
+			log.Error(err.Error())
+			return volume.Response{Err: err.Error()}
+		}
+		log.Infof("volume '%v' already exists, nothing to create", r.Name)
+		return volume.Response{}
+	}
+
+	sourceId, sourceSize := "", 0
+	if opts.FromSnapshot != "" || opts.FromImage != "" {
+		sourceId, sourceSize, err = d.resolveVolumeSource(opts)
+		if err != nil {
+			log.Error(err.Error())
+			return volume.Response{Err: err.Error()}
+		}
+
+		if opts.Size < sourceSize {
+			if _, ok := r.Options[OptionSize]; ok {
+				err = fmt.Errorf("requested size of %d GB is smaller than the %d GB of '%v'", opts.Size, sourceSize, sourceId)
+				log.Error(err.Error())
+				return volume.Response{Err: err.Error()}
+			}
+			opts.Size = sourceSize
+		}
+		// the licence type is inherited from the snapshot or image
+		opts.LicenceType = ""
+	}
 
-	vol = profitbricks.AttachVolume(d.datacenterId, d.serverId, vol.Id)
-	err = d.waitTillProvisioned(vol.Headers.Get("Location"))
+	if profile, member := d.takePoolVolume(opts); member != nil {
+		err = d.beginProvisioning(r.Name, "", opts, "")
+		if err != nil {
+			d.pool.put(profile, member)
+			log.Errorf("failed to create volume '%v': %v", r.Name, err)
+			return volume.Response{Err: err.Error()}
+		}
+		go d.provisionFromPool(r.Name, profile, member, opts)
 
+		log.Infof("claiming %v pool volume '%v' for volume '%v' in the background", profile, member.volumeId, r.Name)
+		return volume.Response{}
+	}
+
+	entry, err := d.journal.Begin(OperationCreate, r.Name, d.datacenterId, d.serverId)
 	if err != nil {
 		log.Error(err.Error())
 		return volume.Response{Err: err.Error()}
 	}
+	entry.MountPoint = filepath.Join(d.mountPath, r.Name)
 
-	volumeName, err := d.utilities.GetDeviceName()
+	err = d.beginProvisioning(r.Name, "", opts, sourceId)
 	if err != nil {
-		log.Error(err.Error())
+		log.Errorf("failed to create volume '%v': %v", r.Name, err)
+		if finishErr := d.journal.Finish(entry); finishErr != nil {
+			log.Error(finishErr.Error())
+		}
 		return volume.Response{Err: err.Error()}
 	}
+	go d.provision(entry, opts, sourceId, sourceSize)
+
+	log.Infof("provisioning volume '%v' in the background", r.Name)
+	return volume.Response{}
+}
+
+// adoptedOptions checks a create request against a cloud volume that is
+// about to be adopted for it and returns the options of the adopted
+// volume. Only the options that can be read back from the API are
+// compared and taken from the volume; the others are taken from the
+// request. The filesystem is only compared once it is known.
+func adoptedOptions(vol CloudVolume, filesystem string, requested map[string]string, opts VolumeOptions) (VolumeOptions, error) {
+	merged := opts
+	merged.Size = vol.Size
+	merged.DiskType = vol.Type
+	merged.AvailabilityZone = vol.AvailabilityZone
+	merged.Bus = vol.Bus
+	merged.LicenceType = vol.LicenceType
+	merged.Filesystem = filesystem
+
+	cloud := make(map[string]string)
+	for key, value := range requested {
+		key = strings.ToLower(key)
+		if cloudOptions[key] && (key != OptionFilesystem || filesystem != "") {
+			cloud[key] = value
+		}
+	}
+
+	if conflicts := merged.Conflicts(cloud, opts); len(conflicts) > 0 {
+		return merged, fmt.Errorf("cloud volume '%v' exists with different values for %v", vol.Id, strings.Join(conflicts, ", "))
+	}
+	return merged, nil
+}
 
-	err = d.utilities.FormatVolume(volumeName)
+// initFilesystem formats the device of a new volume. Volumes created from a
+// snapshot or image keep their filesystem, which is grown if the volume is
+// larger than its source.
+func (d *Driver) initFilesystem(name string, deviceName string, mountPoint string, opts *VolumeOptions, sourceId string, sourceSize int) error {
+	existing, err := d.utilities.GetFilesystem(deviceName)
 	if err != nil {
-		log.Error(err.Error())
-		return volume.Response{Err: err.Error()}
+		return err
 	}
 
-	volumePath := filepath.Join(d.mountPath, volumeName)
+	if sourceId != "" {
+		if existing == "" {
+			return fmt.Errorf("device '%v' of volume '%v' created from '%v' contains no filesystem", deviceName, name, sourceId)
+		}
+		opts.Filesystem = existing
 
-	err = os.MkdirAll(volumePath, MountDirMode)
+		if opts.Size > sourceSize {
+			log.Infof("growing the %v filesystem of volume '%v' from %d GB to %d GB", existing, name, sourceSize, opts.Size)
+			return d.utilities.GrowFilesystem(deviceName, mountPoint, existing)
+		}
+		return nil
+	}
+
+	if existing != "" && !opts.ForceFormat {
+		return fmt.Errorf("device '%v' of volume '%v' already contains a %v filesystem, refusing to format it without -o %v=true", deviceName, name, existing, OptionForceFormat)
+	}
+
+	return d.utilities.FormatVolume(deviceName, opts.Filesystem, opts.MkfsOptions, existing != "")
+}
+
+func (d *Driver) Mount(r volume.MountRequest) volume.Response {
+	err := d.waitForProvisioning(r.Name)
 	if err != nil {
 		log.Error(err.Error())
 		return volume.Response{Err: err.Error()}
 	}
 
-	metadataFilePath := filepath.Join(d.metadataPath, r.Name)
+	defer d.locks.lock(r.Name)()
+
+	state, ok := d.lookupVolume(r.Name)
+	if !ok {
+		return volume.Response{Err: fmt.Sprintf("Volume %q does not exist", r.Name)}
+	}
 
-	metadataFile, err := os.Create(metadataFilePath)
+	err = state.checkProvisioned()
+	if err == nil && state.Operation == OperationRestore {
+		err = state.checkIdle()
+	}
 	if err != nil {
-		log.Errorf("failed to create metadata file '%v' for volume '%v'", metadataFilePath, r.Name)
+		log.Error(err.Error())
 		return volume.Response{Err: err.Error()}
 	}
 
-	err = metadataFile.Chmod(MetadataFileMode)
+	mounted, err := d.utilities.IsMounted(state.MountPoint)
 	if err != nil {
-		os.Remove(metadataFilePath)
-		log.Errorf("failed to change the mode for the metadata file '%v' for volume '%v'", metadataFilePath, r.Name)
+		log.Error(err.Error())
 		return volume.Response{Err: err.Error()}
 	}
 
-	d.volumes[r.Name] = &VolumeState{
-		volumeId:   vol.Id,
-		mountPoint: volumePath,
-		deviceName: volumeName,
+	if !mounted {
+		if len(state.Mounts) > 0 {
+			log.Warnf("volume '%v' has %d active mount(s) recorded but is not mounted, mounting it again", r.Name, len(state.Mounts))
+		}
+
+		device, err := d.utilities.ResolveDevice(state.VolumeId, state.DeviceNumber, state.Options.Bus, state.Options.Size, DeviceWaitTimeout)
+		if err != nil {
+			log.Error(err.Error())
+			return volume.Response{Err: err.Error()}
+		}
+		d.refreshSize(state, device)
+		if device != state.DeviceName {
+			log.Infof("volume '%v' moved from device '%v' to '%v'", r.Name, state.DeviceName, device)
+			state.DeviceName = device
+		}
+
+		err = d.utilities.MountVolume(state.DeviceName, state.MountPoint, state.Filesystem, state.Options.MountOptions)
+		if err != nil {
+			log.Error(err.Error())
+			return volume.Response{Err: err.Error()}
+		}
 	}
 
-	return volume.Response{}
-}
+	if !state.hasMount(r.ID) {
+		state.Mounts = append(state.Mounts, r.ID)
+	}
 
-func (d *Driver) Mount(r volume.MountRequest) volume.Response {
-	d.m.Lock()
-	defer d.m.Unlock()
-	err := d.utilities.MountVolume(r.Name, d.volumes[r.Name].mountPoint)
+	err = d.saveVolumeState(state)
 	if err != nil {
 		log.Error(err.Error())
 		return volume.Response{Err: err.Error()}
 	}
 
-	return volume.Response{}
+	return volume.Response{Mountpoint: state.MountPoint}
 }
 
 func (d *Driver) Unmount(r volume.UnmountRequest) volume.Response {
-	d.m.Lock()
-	defer d.m.Unlock()
+	defer d.locks.lock(r.Name)()
+
+	state, ok := d.lookupVolume(r.Name)
+	if !ok {
+		return volume.Response{Err: fmt.Sprintf("Volume %q does not exist", r.Name)}
+	}
+
+	if !state.hasMount(r.ID) {
+		log.Warnf("volume '%v' has no active mount with id '%v'", r.Name, r.ID)
+	}
+
+	mounts := state.Mounts
+	state.removeMount(r.ID)
+
+	if len(state.Mounts) == 0 {
+		// a volume that is no longer mounted, for example after a reboot,
+		// counts as unmounted
+		mounted, err := d.utilities.IsMounted(state.MountPoint)
+		if err == nil && mounted {
+			err = d.utilities.UnmountVolume(state.MountPoint)
+		}
+		if err != nil {
+			state.Mounts = mounts
+			log.Error("Error occured while unmounting volume", err.Error())
+			return volume.Response{Err: err.Error()}
+		}
+		if !mounted {
+			log.Warnf("volume '%v' was not mounted on '%v'", r.Name, state.MountPoint)
+		}
+	}
 
-	err := d.utilities.UnmountVolume(d.volumes[r.Name].mountPoint)
+	err := d.saveVolumeState(state)
 	if err != nil {
-		log.Error("Error occured while unmounting volume", err.Error())
+		log.Error(err.Error())
 		return volume.Response{Err: err.Error()}
 	}
 	return volume.Response{}
 }
 
 func (d *Driver) List(r volume.Request) volume.Response {
-	d.m.Lock()
-	defer d.m.Unlock()
-	return volume.Response{}
+	volumes := []*volume.Volume{}
+
+	for _, name := range d.volumeNames() {
+		if vol := d.listedVolume(name); vol != nil {
+			volumes = append(volumes, vol)
+		}
+	}
+	return volume.Response{Volumes: volumes}
+}
+
+// listedVolume returns the volume as listed, reading its record under its
+// lock. It returns nil if the volume was removed in the meantime.
+func (d *Driver) listedVolume(name string) *volume.Volume {
+	defer d.locks.lock(name)()
+
+	state, ok := d.lookupVolume(name)
+	if !ok {
+		return nil
+	}
+	return &volume.Volume{Name: name, Mountpoint: state.MountPoint}
 }
 
 func (d *Driver) Get(r volume.Request) volume.Response {
-	volumes := []*volume.Volume{}
+	defer d.locks.lock(r.Name)()
 
-	for name, state := range d.volumes {
-		volumes = append(volumes, &volume.Volume{
-			Name:       name,
-			Mountpoint: state.mountPoint,
-		})
+	state, ok := d.lookupVolume(r.Name)
+	if !ok {
+		return volume.Response{Err: fmt.Sprintf("Volume %q does not exist", r.Name)}
 	}
-	return volume.Response{Volumes: volumes}
+
+	return volume.Response{Volume: &volume.Volume{
+		Name:       r.Name,
+		Mountpoint: state.MountPoint,
+		Status:     state.status(),
+	}}
 }
 
 func (d *Driver) Remove(r volume.Request) volume.Response {
-	d.m.Lock()
-	defer d.m.Unlock()
+	defer d.locks.lock(r.Name)()
 
-	resp := profitbricks.DetachVolume(d.datacenterId, d.serverId, d.volumes[r.Name].volumeId)
-	if resp.StatusCode > 299 {
-		log.Errorf("failed to create metadata file '%v' for volume '%v'", d.metadataPath, r.Name)
-		return volume.Response{Err: string(resp.Body)}
+	state, ok := d.lookupVolume(r.Name)
+	if !ok {
+		log.Infof("volume '%v' does not exist, nothing to remove", r.Name)
+		return volume.Response{}
 	}
 
-	err := d.waitTillProvisioned(resp.Headers.Get("Location"))
-	if err != nil {
+	if len(state.Mounts) > 0 {
+		return volume.Response{Err: fmt.Sprintf("Volume %q is still mounted by %d container(s)", r.Name, len(state.Mounts))}
+	}
+	if err := state.checkIdle(); err != nil {
 		return volume.Response{Err: err.Error()}
 	}
 
-	resp = profitbricks.DeleteVolume(d.datacenterId, d.volumes[r.Name].volumeId)
-	if resp.StatusCode > 299 {
-		log.Errorf("failed to create metadata file '%v' for volume '%v'", d.metadataPath, r.Name)
-		return volume.Response{Err: string(resp.Body)}
+	switch state.Status {
+	case VolumeStatusProvisioning:
+		return volume.Response{Err: state.checkProvisioned().Error()}
+	case VolumeStatusFailed:
+		// the cloud volume of a failed create was rolled back, the one of a
+		// failed adoption is left as it was found
+		err := d.removeVolumeState(r.Name)
+		if err != nil {
+			log.Errorf("failed to remove volume '%v': %v", r.Name, err)
+			return volume.Response{Err: err.Error()}
+		}
+		d.forgetVolume(r.Name)
+		return volume.Response{}
 	}
 
-	err = d.waitTillProvisioned(resp.Headers.Get("Location"))
+	entry, err := d.journal.Begin(OperationRemove, r.Name, state.DatacenterId, state.ServerId)
 	if err != nil {
+		log.Error(err.Error())
+		return volume.Response{Err: err.Error()}
+	}
+	entry.VolumeId = state.VolumeId
+
+	err = d.finishRemove(entry)
+	if err != nil {
+		log.Errorf("failed to remove volume '%v': %v", r.Name, err)
 		return volume.Response{Err: err.Error()}
 	}
 
 	return volume.Response{}
 }
 
+// finishRemove detaches and deletes the volume of a journaled remove and
+// drops its record. Steps that already completed are skipped, so it is
+// also used to finish an interrupted remove.
+func (d *Driver) finishRemove(entry *JournalEntry) error {
+	if step := entry.step(StepDetachVolume); step == nil || !step.Done {
+		err := d.journal.Step(entry, StepDetachVolume)
+		if err != nil {
+			return err
+		}
+
+		location, err := d.provider.DetachVolume(entry.DatacenterId, entry.ServerId, entry.VolumeId)
+		if err != nil && !isNotFound(err) {
+			return fmt.Errorf("failed to detach volume '%v': %v", entry.VolumeId, err)
+		}
+
+		err = d.waitForStep(entry, location)
+		if err != nil {
+			return err
+		}
+	}
+
+	if step := entry.step(StepDeleteVolume); step == nil || !step.Done {
+		err := d.journal.Step(entry, StepDeleteVolume)
+		if err != nil {
+			return err
+		}
+
+		location, err := d.provider.DeleteVolume(entry.DatacenterId, entry.VolumeId)
+		if err != nil && !isNotFound(err) {
+			return fmt.Errorf("failed to delete volume '%v': %v", entry.VolumeId, err)
+		}
+
+		err = d.waitForStep(entry, location)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := d.removeVolumeState(entry.Volume)
+	if err != nil {
+		return fmt.Errorf("failed to remove metadata for volume '%v': %v", entry.Volume, err)
+	}
+	d.forgetVolume(entry.Volume)
+
+	return d.journal.Finish(entry)
+}
+
+// dropStaleMounts forgets the mounts recorded for volumes that are not
+// mounted on the host, which happens when the host rebooted or the plugin
+// crashed. Docker does not unmount them, so they would keep the volumes
+// from being removed or restored forever.
+func (d *Driver) dropStaleMounts() {
+	for _, state := range d.volumes {
+		if len(state.Mounts) == 0 {
+			continue
+		}
+
+		mounted, err := d.utilities.IsMounted(state.MountPoint)
+		if err != nil {
+			log.Errorf("volume '%v': %v", state.Name, err)
+			continue
+		}
+		if mounted {
+			continue
+		}
+
+		log.Warnf("volume '%v' has %d mount(s) recorded but is not mounted, dropping them", state.Name, len(state.Mounts))
+		state.Mounts = nil
+		err = d.saveVolumeState(state)
+		if err != nil {
+			log.Error(err.Error())
+		}
+	}
+}
+
 func (d *Driver) Path(r volume.Request) volume.Response {
-	d.m.Lock()
-	defer d.m.Unlock()
+	defer d.locks.lock(r.Name)()
 
-	if state, ok := d.volumes[r.Name]; ok {
-		return volume.Response{Mountpoint: state.mountPoint}
+	if state, ok := d.lookupVolume(r.Name); ok {
+		return volume.Response{Mountpoint: state.MountPoint}
 	}
 
 	return volume.Response{Err: fmt.Sprintf("Volume %q does not exist", r.Name)}
@@ -228,33 +583,46 @@ func (d *Driver) Capabilities(r volume.Request) volume.Response {
 	return volume.Response{Capabilities: volume.Capability{Scope: "local"}}
 }
 
-func (d *Driver) waitTillProvisioned(path string) error {
-
-	waitCount := 50
-
-	for i := 0; i < waitCount; i++ {
-		request := profitbricks.GetRequestStatus(path)
-		log.Info("Request status: %s", request.Metadata.Status)
-		log.Info("Request status path: %s", path)
+// waitForStep records the request location of the current journal step,
+// waits for the request and records the step as done.
+func (d *Driver) waitForStep(entry *JournalEntry, location string) error {
+	err := d.journal.Location(entry, location)
+	if err != nil {
+		return err
+	}
 
-		if request.Metadata.Status == "DONE" {
-			return nil
+	if location != "" {
+		err = d.provider.Wait(d.ctx, location)
+		if err != nil {
+			return err
 		}
-		if request.Metadata.Status == "FAILED" {
+	}
 
-			return fmt.Errorf("Request failed with following error: %s", request.Metadata.Message)
-		}
-		time.Sleep(10 * time.Second)
-		i++
+	return d.journal.Done(entry)
+}
+
+// detachVolume detaches the volume and waits for the request. A volume that
+// is not attached counts as detached.
+func (d *Driver) detachVolume(datacenterId string, serverId string, volumeId string) error {
+	location, err := d.provider.DetachVolume(datacenterId, serverId, volumeId)
+	if isNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to detach volume '%v': %v", volumeId, err)
 	}
-	return fmt.Errorf("Timeout has expired %s", "")
+	return d.provider.Wait(d.ctx, location)
 }
 
-//
-//func getDeviceName(deviceNumber int64) string {
-//	alphabet := []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j", "k", "l", "m", "n", "o", "p", "q", "r", "s", "t", "u", "v", "w", "x", "y", "z"}
-//
-//	name := fmt.Sprintf("vd%s", alphabet[deviceNumber - 1])
-//
-//	return name
-//}
+// deleteVolume deletes the volume and waits for the request. A volume that
+// does not exist counts as deleted.
+func (d *Driver) deleteVolume(datacenterId string, volumeId string) error {
+	location, err := d.provider.DeleteVolume(datacenterId, volumeId)
+	if isNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete volume '%v': %v", volumeId, err)
+	}
+	return d.provider.Wait(d.ctx, location)
+}
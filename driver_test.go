@@ -0,0 +1,789 @@
+package main
+
+import (
+	"context"
+	"github.com/denza/docker-volume-profitbricks/fakecloud"
+	"github.com/denza/docker-volume-profitbricks/fakehost"
+	"github.com/docker/go-plugins-helpers/volume"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+var _ HostUtilities = (*fakehost.Host)(nil)
+
+const (
+	testDatacenterId = "00000000-0000-0000-0000-000000000001"
+	testServerId     = "00000000-0000-0000-0000-000000000002"
+	testVolumeSize   = 5
+	testWait         = 30 * time.Second
+)
+
+// testEnv runs drivers against a fake cloud and a fake host that shows the
+// devices of the volumes attached in the fake cloud.
+type testEnv struct {
+	t            *testing.T
+	cloud        *fakecloud.Server
+	api          *httptest.Server
+	host         *fakehost.Host
+	provider     *ProfitBricksProvider
+	metadataPath string
+	mountPath    string
+	diskType     string
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	installSDKTransport()
+
+	cloud := fakecloud.NewServer(fakecloud.Config{})
+	cloud.AddServer(testDatacenterId, testServerId)
+
+	api := httptest.NewServer(cloud)
+	t.Cleanup(api.Close)
+
+	return &testEnv{
+		t:     t,
+		cloud: cloud,
+		api:   api,
+		host: fakehost.NewHost(fakehost.Config{
+			ServerId: testServerId,
+			Attached: func() []string {
+				return cloud.AttachedVolumeIds(testDatacenterId, testServerId)
+			},
+			VolumeSize: func(volumeId string) int {
+				size, _ := cloud.VolumeSize(testDatacenterId, volumeId)
+				return size
+			},
+		}),
+		provider:     NewProfitBricksProvider("user", "password", api.URL+fakecloud.BasePath, time.Minute),
+		metadataPath: t.TempDir(),
+		mountPath:    t.TempDir(),
+		diskType:     "HDD",
+	}
+}
+
+// newDriver starts a driver on the metadata of the environment, with a
+// pool of poolSize volumes of the default profile.
+func (e *testEnv) newDriver(poolSize int) *Driver {
+	return startDriver(e.t, e.provider, e.host, testArgs(e.metadataPath, e.mountPath, testDatacenterId, e.diskType, poolSize))
+}
+
+func testArgs(metadataPath string, mountPath string, datacenterId string, diskType string, poolSize int) CommandLineArgs {
+	size := testVolumeSize
+	mountWait := testWait
+	poolProfiles := ""
+	poolCleanup := false
+
+	return CommandLineArgs{
+		metadataPath: &metadataPath,
+		mountPath:    &mountPath,
+		datacenterId: &datacenterId,
+		size:         &size,
+		diskType:     &diskType,
+		mountWait:    &mountWait,
+		poolSize:     &poolSize,
+		poolProfiles: &poolProfiles,
+		poolCleanup:  &poolCleanup,
+	}
+}
+
+// startDriver starts a driver that is stopped when the test is done.
+func startDriver(t *testing.T, provider BlockStorageProvider, host HostUtilities, args CommandLineArgs) *Driver {
+	d, err := ProfitBricksDriver(provider, host, args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		d.waitForBackground(testWait)
+		d.cancel()
+	})
+	return d
+}
+
+// create creates the volume and waits until it is provisioned.
+func (e *testEnv) create(d *Driver, name string, options map[string]string) map[string]interface{} {
+	res := d.Create(volume.Request{Name: name, Options: options})
+	if res.Err != "" {
+		e.t.Fatalf("Create(%v) failed: %v", name, res.Err)
+	}
+	if !d.waitForBackground(testWait) {
+		e.t.Fatalf("volume '%v' is still being provisioned after %v", name, testWait)
+	}
+	return e.status(d, name)
+}
+
+// status returns the status `docker volume inspect` shows for the volume.
+func (e *testEnv) status(d *Driver, name string) map[string]interface{} {
+	res := d.Get(volume.Request{Name: name})
+	if res.Err != "" {
+		e.t.Fatalf("Get(%v) failed: %v", name, res.Err)
+	}
+	return res.Volume.Status
+}
+
+func (e *testEnv) cloudVolume(volumeId string) CloudVolume {
+	vol, err := e.provider.GetVolume(testDatacenterId, volumeId)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	return vol
+}
+
+func (e *testEnv) attachedVolumeIds() []string {
+	return e.cloud.AttachedVolumeIds(testDatacenterId, testServerId)
+}
+
+func (e *testEnv) isMounted(d *Driver, name string) bool {
+	mounted, err := e.host.IsMounted(d.Path(volume.Request{Name: name}).Mountpoint)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	return mounted
+}
+
+// device returns the device of the fake host at the path.
+func (e *testEnv) device(path interface{}) fakehost.Device {
+	for _, dev := range e.host.Devices() {
+		if dev.Path == path {
+			return dev
+		}
+	}
+	e.t.Fatalf("device '%v' does not exist", path)
+	return fakehost.Device{}
+}
+
+func checkReady(t *testing.T, name string, status map[string]interface{}) {
+	if status["state"] != VolumeStatusReady {
+		t.Fatalf("volume '%v' is %v, want %v: %v", name, status["state"], VolumeStatusReady, status["error"])
+	}
+}
+
+func TestCreate(t *testing.T) {
+	e := newTestEnv(t)
+	d := e.newDriver(0)
+
+	status := e.create(d, "data", map[string]string{"size": "10", "fs": "xfs"})
+	checkReady(t, "data", status)
+
+	volumeId := status["volumeId"].(string)
+	vol := e.cloudVolume(volumeId)
+	if vol.Name != VolumeNamePrefix+"data" || vol.Size != 10 {
+		t.Errorf("cloud volume is %q of %d GB, want %q of 10 GB", vol.Name, vol.Size, VolumeNamePrefix+"data")
+	}
+	if ids := e.attachedVolumeIds(); len(ids) != 1 || ids[0] != volumeId {
+		t.Errorf("attached volumes are %v, want [%v]", ids, volumeId)
+	}
+	if fs, _ := e.host.GetFilesystem(status["device"].(string)); fs != "xfs" {
+		t.Errorf("device '%v' has filesystem %q, want xfs", status["device"], fs)
+	}
+}
+
+func TestListWhileCreating(t *testing.T) {
+	e := newTestEnv(t)
+	d := e.newDriver(0)
+
+	names := []string{"data0", "data1", "data2", "data3"}
+	created := make(chan struct{})
+	go func() {
+		defer close(created)
+		for _, name := range names {
+			if res := d.Create(volume.Request{Name: name}); res.Err != "" {
+				t.Errorf("Create(%v) failed: %v", name, res.Err)
+			}
+		}
+		d.waitForBackground(testWait)
+	}()
+
+	for listing := true; listing; {
+		select {
+		case <-created:
+			listing = false
+		default:
+		}
+		for _, vol := range d.List(volume.Request{}).Volumes {
+			if res := d.Path(volume.Request{Name: vol.Name}); res.Mountpoint != vol.Mountpoint {
+				t.Errorf("Path(%v) is %q, listed as %q", vol.Name, res.Mountpoint, vol.Mountpoint)
+			}
+		}
+	}
+
+	if volumes := d.List(volume.Request{}).Volumes; len(volumes) != len(names) {
+		t.Errorf("listed %d volumes, want %d", len(volumes), len(names))
+	}
+	for _, name := range names {
+		checkReady(t, name, e.status(d, name))
+	}
+}
+
+func TestCreateRollsBackFailedAttach(t *testing.T) {
+	e := newTestEnv(t)
+	d := e.newDriver(0)
+
+	e.cloud.Inject(fakecloud.Fault{Method: "POST", Path: "/servers/", Times: 1})
+	status := e.create(d, "data", nil)
+
+	if status["state"] != VolumeStatusFailed {
+		t.Fatalf("volume is %v, want %v", status["state"], VolumeStatusFailed)
+	}
+	if !strings.Contains(status["error"].(string), "rolled back") {
+		t.Errorf("error %q does not report the rollback", status["error"])
+	}
+	if ids := e.cloud.VolumeIds(testDatacenterId); len(ids) != 0 {
+		t.Errorf("cloud volumes after the rollback are %v, want none", ids)
+	}
+	if pending, _ := d.journal.Pending(); len(pending) != 0 {
+		t.Errorf("%d journal entries are left after the rollback", len(pending))
+	}
+
+	res := d.Mount(volume.MountRequest{Name: "data", ID: "c1"})
+	if !strings.Contains(res.Err, "failed to provision") {
+		t.Errorf("Mount of a failed volume returned %q", res.Err)
+	}
+	if res := d.Remove(volume.Request{Name: "data"}); res.Err != "" {
+		t.Errorf("Remove of a failed volume failed: %v", res.Err)
+	}
+}
+
+func TestCreateIsIdempotent(t *testing.T) {
+	e := newTestEnv(t)
+	d := e.newDriver(0)
+
+	options := map[string]string{"size": "10"}
+	status := e.create(d, "data", options)
+	checkReady(t, "data", status)
+
+	if res := d.Create(volume.Request{Name: "data", Options: options}); res.Err != "" {
+		t.Errorf("repeated Create failed: %v", res.Err)
+	}
+	if res := d.Create(volume.Request{Name: "data"}); res.Err != "" {
+		t.Errorf("Create without options failed: %v", res.Err)
+	}
+
+	res := d.Create(volume.Request{Name: "data", Options: map[string]string{"size": "20"}})
+	if !strings.Contains(res.Err, "different values for size") {
+		t.Errorf("conflicting Create returned %q", res.Err)
+	}
+
+	if ids := e.cloud.VolumeIds(testDatacenterId); len(ids) != 1 {
+		t.Errorf("cloud volumes are %v, want one", ids)
+	}
+	if got := e.status(d, "data")["volumeId"]; got != status["volumeId"] {
+		t.Errorf("volume ID changed from %v to %v", status["volumeId"], got)
+	}
+}
+
+func TestMountIsCounted(t *testing.T) {
+	e := newTestEnv(t)
+	d := e.newDriver(0)
+	checkReady(t, "data", e.create(d, "data", nil))
+
+	first := d.Mount(volume.MountRequest{Name: "data", ID: "c1"})
+	second := d.Mount(volume.MountRequest{Name: "data", ID: "c2"})
+	if first.Err != "" || second.Err != "" {
+		t.Fatalf("Mount failed: %q, %q", first.Err, second.Err)
+	}
+	if first.Mountpoint != second.Mountpoint {
+		t.Errorf("mounts returned %v and %v", first.Mountpoint, second.Mountpoint)
+	}
+
+	if res := d.Unmount(volume.UnmountRequest{Name: "data", ID: "c1"}); res.Err != "" {
+		t.Fatalf("Unmount failed: %v", res.Err)
+	}
+	if !e.isMounted(d, "data") {
+		t.Error("volume was unmounted while a container still uses it")
+	}
+	if res := d.Remove(volume.Request{Name: "data"}); !strings.Contains(res.Err, "still mounted") {
+		t.Errorf("Remove of a mounted volume returned %q", res.Err)
+	}
+
+	if res := d.Unmount(volume.UnmountRequest{Name: "data", ID: "c2"}); res.Err != "" {
+		t.Fatalf("Unmount failed: %v", res.Err)
+	}
+	if e.isMounted(d, "data") {
+		t.Error("volume is still mounted after the last unmount")
+	}
+
+	if res := d.Remove(volume.Request{Name: "data"}); res.Err != "" {
+		t.Fatalf("Remove failed: %v", res.Err)
+	}
+	if ids := e.cloud.VolumeIds(testDatacenterId); len(ids) != 0 {
+		t.Errorf("cloud volumes after Remove are %v, want none", ids)
+	}
+}
+
+func TestReplayRollsBackInterruptedCreate(t *testing.T) {
+	e := newTestEnv(t)
+
+	// a create that was interrupted once the volume was attached
+	vol, location, err := e.provider.CreateVolume(testDatacenterId, CloudVolume{Size: testVolumeSize, Name: VolumeNamePrefix + "data"})
+	if err == nil {
+		err = e.provider.Wait(context.Background(), location)
+	}
+	if err == nil {
+		location, err = e.provider.AttachVolume(testDatacenterId, testServerId, vol.Id)
+	}
+	if err == nil {
+		err = e.provider.Wait(context.Background(), location)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	journal, err := NewJournal(e.metadataPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err := journal.Begin(OperationCreate, "data", testDatacenterId, testServerId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry.VolumeId = vol.Id
+	for _, step := range []string{StepCreateVolume, StepAttachVolume} {
+		if err := journal.Step(entry, step); err != nil {
+			t.Fatal(err)
+		}
+		if err := journal.Done(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d := e.newDriver(0)
+	if !d.waitForBackground(testWait) {
+		t.Fatalf("replay is still running after %v", testWait)
+	}
+
+	if ids := e.cloud.VolumeIds(testDatacenterId); len(ids) != 0 {
+		t.Errorf("cloud volumes after the replay are %v, want none", ids)
+	}
+	if pending, _ := d.journal.Pending(); len(pending) != 0 {
+		t.Errorf("%d journal entries are left after the replay", len(pending))
+	}
+	if res := d.Get(volume.Request{Name: "data"}); res.Err == "" {
+		t.Errorf("interrupted volume exists after the replay: %v", res.Volume.Status)
+	}
+}
+
+func TestRestartAdoptsAttachedVolume(t *testing.T) {
+	e := newTestEnv(t)
+	created := e.create(e.newDriver(0), "data", map[string]string{"fs": "btrfs"})
+	checkReady(t, "data", created)
+
+	// the records of the volumes are lost
+	e.metadataPath = t.TempDir()
+	d := e.newDriver(0)
+
+	status := e.status(d, "data")
+	checkReady(t, "data", status)
+	if status["volumeId"] != created["volumeId"] || status["filesystem"] != "btrfs" {
+		t.Errorf("adopted volume is %v with %v, want %v with btrfs", status["volumeId"], status["filesystem"], created["volumeId"])
+	}
+
+	if res := d.Mount(volume.MountRequest{Name: "data", ID: "c1"}); res.Err != "" {
+		t.Errorf("Mount of the adopted volume failed: %v", res.Err)
+	}
+}
+
+func TestCreateClaimsPoolVolume(t *testing.T) {
+	e := newTestEnv(t)
+	d := e.newDriver(1)
+	go d.pool.Run()
+	defer d.pool.Close()
+
+	profile := PoolProfile{Size: testVolumeSize, DiskType: "HDD", Filesystem: DefaultFilesystem}
+	deadline := time.Now().Add(testWait)
+	for d.pool.count(profile) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("the pool has no %v volume after %v", profile, testWait)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	pooled := e.cloud.VolumeIds(testDatacenterId)
+
+	status := e.create(d, "data", nil)
+	checkReady(t, "data", status)
+
+	if len(pooled) != 1 || status["volumeId"] != pooled[0] {
+		t.Fatalf("volume is %v, want the pool volume %v", status["volumeId"], pooled)
+	}
+	if vol := e.cloudVolume(pooled[0]); vol.Name != VolumeNamePrefix+"data" {
+		t.Errorf("claimed pool volume is named %q", vol.Name)
+	}
+	if res := d.Mount(volume.MountRequest{Name: "data", ID: "c1"}); res.Err != "" {
+		t.Errorf("Mount of the claimed volume failed: %v", res.Err)
+	}
+}
+
+func TestResizeGrowsVolumeAndFilesystem(t *testing.T) {
+	e := newTestEnv(t)
+	d := e.newDriver(0)
+	status := e.create(d, "data", nil)
+	checkReady(t, "data", status)
+	volumeId := status["volumeId"].(string)
+
+	if res := d.Mount(volume.MountRequest{Name: "data", ID: "c1"}); res.Err != "" {
+		t.Fatalf("Mount failed: %v", res.Err)
+	}
+
+	// online, then offline
+	for i, size := range []int{8, 10} {
+		state, err := d.Resize("data", size)
+		if err != nil {
+			t.Fatalf("Resize to %d GB failed: %v", size, err)
+		}
+		if state.Options.Size != size {
+			t.Errorf("volume has %d GB after the resize, want %d", state.Options.Size, size)
+		}
+		if vol := e.cloudVolume(volumeId); vol.Size != size {
+			t.Errorf("cloud volume has %d GB, want %d", vol.Size, size)
+		}
+		dev := e.device(state.DeviceName)
+		if dev.Size != size || dev.FilesystemSize != size {
+			t.Errorf("device has %d GB and a filesystem of %d GB, want %d", dev.Size, dev.FilesystemSize, size)
+		}
+
+		if i == 0 {
+			if res := d.Unmount(volume.UnmountRequest{Name: "data", ID: "c1"}); res.Err != "" {
+				t.Fatalf("Unmount failed: %v", res.Err)
+			}
+		}
+	}
+
+	if _, err := d.Resize("data", 6); err == nil || !strings.Contains(err.Error(), "cannot be shrunk") {
+		t.Errorf("Resize to a smaller size returned %v", err)
+	}
+	if vol := e.cloudVolume(volumeId); vol.Size != 10 {
+		t.Errorf("cloud volume has %d GB after a refused shrink, want 10", vol.Size)
+	}
+}
+
+func TestAutogrowStopsAtMaxSize(t *testing.T) {
+	e := newTestEnv(t)
+	d := e.newDriver(0)
+	status := e.create(d, "data", map[string]string{"max_size": "8", "grow_step": "2"})
+	checkReady(t, "data", status)
+	device := status["device"].(string)
+
+	if res := d.Mount(volume.MountRequest{Name: "data", ID: "c1"}); res.Err != "" {
+		t.Fatalf("Mount failed: %v", res.Err)
+	}
+
+	monitor := NewAutogrowMonitor(d, DefaultGrowThreshold, DefaultGrowStep, DefaultGrowInterval)
+	for _, size := range []int{7, 8, 8} {
+		if err := e.host.SetUsage(device, 95); err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range monitor.candidates() {
+			monitor.check(c)
+		}
+
+		if got := e.status(d, "data")["size"]; got != size {
+			t.Fatalf("volume has %v GB, want %d", got, size)
+		}
+	}
+
+	if vol := e.cloudVolume(status["volumeId"].(string)); vol.Size != 8 {
+		t.Errorf("cloud volume has %d GB, want the max_size of 8", vol.Size)
+	}
+	if dev := e.device(device); dev.FilesystemSize != 8 {
+		t.Errorf("filesystem has %d GB, want 8", dev.FilesystemSize)
+	}
+}
+
+func TestRestoreBringsBackSnapshotData(t *testing.T) {
+	e := newTestEnv(t)
+	d := e.newDriver(0)
+	status := e.create(d, "data", nil)
+	checkReady(t, "data", status)
+	volumeId := status["volumeId"].(string)
+
+	if err := e.cloud.SetVolumeData(testDatacenterId, volumeId, "before"); err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := d.Snapshot("data", "")
+	if err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	if err := e.cloud.SetVolumeData(testDatacenterId, volumeId, "after"); err != nil {
+		t.Fatal(err)
+	}
+
+	state, err := d.Restore("data", snapshot.Id)
+	if err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	if data, _ := e.cloud.VolumeData(testDatacenterId, volumeId); data != "before" {
+		t.Errorf("volume holds %q after the restore, want %q", data, "before")
+	}
+	if state.VolumeId != volumeId || state.Status != VolumeStatusReady {
+		t.Errorf("restored volume is %v and %v, want %v and %v", state.VolumeId, state.Status, volumeId, VolumeStatusReady)
+	}
+	if ids := e.attachedVolumeIds(); len(ids) != 1 || ids[0] != volumeId {
+		t.Errorf("attached volumes after the restore are %v, want [%v]", ids, volumeId)
+	}
+	if res := d.Mount(volume.MountRequest{Name: "data", ID: "c1"}); res.Err != "" {
+		t.Errorf("Mount of the restored volume failed: %v", res.Err)
+	}
+}
+
+// snapshots returns the records of the snapshots of the volume.
+func (e *testEnv) snapshots(d *Driver, name string) []SnapshotRecord {
+	defer d.locks.lock(name)()
+
+	state, ok := d.lookupVolume(name)
+	if !ok {
+		e.t.Fatalf("volume '%v' does not exist", name)
+	}
+	return append([]SnapshotRecord{}, state.Snapshots...)
+}
+
+func TestSchedulerPrunesBeyondRetention(t *testing.T) {
+	e := newTestEnv(t)
+	d := e.newDriver(0)
+	checkReady(t, "data", e.create(d, "data", map[string]string{"snapshot_schedule": "@hourly", "snapshot_keep": "2"}))
+
+	manual, err := d.Snapshot("data", "manual")
+	if err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+
+	scheduler := NewSnapshotScheduler(d, nil)
+	var taken []string
+	for i := 1; i <= 4; i++ {
+		scheduler.runDue(time.Now().Add(time.Duration(i) * time.Hour))
+		records := e.snapshots(d, "data")
+		taken = append(taken, records[len(records)-1].Id)
+	}
+
+	expected := []string{manual.Id, taken[2], taken[3]}
+	var kept []string
+	for _, record := range e.snapshots(d, "data") {
+		kept = append(kept, record.Id)
+	}
+	if !reflect.DeepEqual(kept, expected) {
+		t.Errorf("recorded snapshots are %v, want %v", kept, expected)
+	}
+
+	snapshots, err := e.provider.ListSnapshots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cloudIds []string
+	for _, snapshot := range snapshots {
+		cloudIds = append(cloudIds, snapshot.Id)
+	}
+	sort.Strings(cloudIds)
+	sort.Strings(expected)
+	if !reflect.DeepEqual(cloudIds, expected) {
+		t.Errorf("cloud snapshots are %v, want %v", cloudIds, expected)
+	}
+}
+
+func TestSchedulerBacksOffAfterFailure(t *testing.T) {
+	e := newTestEnv(t)
+	d := e.newDriver(0)
+	checkReady(t, "data", e.create(d, "data", map[string]string{"snapshot_schedule": "@hourly"}))
+
+	// the snapshot requests are accepted but fail
+	e.cloud.Inject(fakecloud.Fault{Method: "POST", Path: "create-snapshot", Times: 2})
+
+	scheduler := NewSnapshotScheduler(d, nil)
+	now := time.Now().Add(time.Hour)
+	for _, run := range []struct {
+		at      time.Duration
+		records int
+	}{
+		{at: 0, records: 1},
+		{at: SchedulerInterval, records: 2},
+		// the second failure doubles the wait
+		{at: 2 * SchedulerInterval, records: 2},
+		{at: 3 * SchedulerInterval, records: 3},
+	} {
+		scheduler.runDue(now.Add(run.at))
+		if records := e.snapshots(d, "data"); len(records) != run.records {
+			t.Fatalf("%d snapshots recorded after the run at %v, want %d", len(records), run.at, run.records)
+		}
+	}
+
+	records := e.snapshots(d, "data")
+	for i, record := range records {
+		if pending := i < 2; record.Pending != pending {
+			t.Errorf("snapshot %v is pending: %v, want %v", record.Id, record.Pending, pending)
+		}
+	}
+}
+
+func TestCreateAgainComparesOptions(t *testing.T) {
+	e := newTestEnv(t)
+	e.diskType = "hdd"
+	d := e.newDriver(0)
+	checkReady(t, "data", e.create(d, "data", nil))
+
+	for _, test := range []struct {
+		options  map[string]string
+		conflict string
+	}{
+		{options: map[string]string{"type": "HDD"}},
+		{options: map[string]string{"type": "hdd", "size": "5"}},
+		{options: map[string]string{"type": "SSD"}, conflict: "type"},
+		{options: map[string]string{"size": "20"}, conflict: "size"},
+		{options: map[string]string{"fs": "xfs"}, conflict: "fs"},
+	} {
+		res := d.Create(volume.Request{Name: "data", Options: test.options})
+		if test.conflict == "" && res.Err != "" {
+			t.Errorf("Create with %v failed: %v", test.options, res.Err)
+		}
+		if test.conflict != "" && !strings.Contains(res.Err, "different values for "+test.conflict) {
+			t.Errorf("Create with %v returned %q, want a conflict on %v", test.options, res.Err, test.conflict)
+		}
+	}
+
+	if ids := e.cloud.VolumeIds(testDatacenterId); len(ids) != 1 {
+		t.Errorf("cloud volumes are %v, want one", ids)
+	}
+}
+
+func TestSnapshotIsRecorded(t *testing.T) {
+	e := newTestEnv(t)
+	d := e.newDriver(0)
+	checkReady(t, "data", e.create(d, "data", nil))
+
+	record, err := d.Snapshot("data", "")
+	if err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	if !strings.HasPrefix(record.Name, VolumeNamePrefix+"data-") || record.Scheduled || record.Pending {
+		t.Errorf("snapshot is recorded as %+v", record)
+	}
+	if records := e.snapshots(d, "data"); len(records) != 1 || records[0] != *record {
+		t.Errorf("recorded snapshots are %+v, want %+v", records, record)
+	}
+
+	snapshots, err := e.provider.ListSnapshots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 1 || snapshots[0].Id != record.Id || snapshots[0].Size != testVolumeSize {
+		t.Errorf("cloud snapshots are %+v, want %v of %d GB", snapshots, record.Id, testVolumeSize)
+	}
+
+	if _, err := d.Snapshot("other", ""); err == nil {
+		t.Error("Snapshot of a volume that does not exist succeeded")
+	}
+}
+
+func TestReplayRollsBackInterruptedClaim(t *testing.T) {
+	profile := PoolProfile{Size: testVolumeSize, DiskType: "HDD", Filesystem: DefaultFilesystem}
+
+	for _, test := range []struct {
+		name    string
+		renamed bool
+		kept    bool
+	}{
+		{name: "renamed", renamed: true},
+		{name: "not renamed", kept: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			e := newTestEnv(t)
+
+			// a pool volume whose claim was interrupted
+			vol, location, err := e.provider.CreateVolume(testDatacenterId, CloudVolume{Size: testVolumeSize, Type: "HDD", Name: PoolVolumePrefix + profile.String()})
+			if err == nil {
+				err = e.provider.Wait(context.Background(), location)
+			}
+			if err == nil {
+				location, err = e.provider.AttachVolume(testDatacenterId, testServerId, vol.Id)
+			}
+			if err == nil {
+				err = e.provider.Wait(context.Background(), location)
+			}
+			if err == nil && test.renamed {
+				location, err = e.provider.UpdateVolume(testDatacenterId, vol.Id, CloudVolume{Name: VolumeNamePrefix + "data"})
+				if err == nil {
+					err = e.provider.Wait(context.Background(), location)
+				}
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			journal, err := NewJournal(e.metadataPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			entry, err := journal.Begin(OperationCreate, "data", testDatacenterId, testServerId)
+			if err == nil {
+				entry.VolumeId = vol.Id
+				err = journal.Step(entry, StepClaimVolume)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			d := e.newDriver(0)
+			if !d.waitForBackground(testWait) {
+				t.Fatalf("replay is still running after %v", testWait)
+			}
+
+			var expected []string
+			if test.kept {
+				expected = []string{vol.Id}
+			}
+			if ids := e.cloud.VolumeIds(testDatacenterId); len(ids) != len(expected) {
+				t.Errorf("cloud volumes after the replay are %v, want %v", ids, expected)
+			}
+			if pending, _ := d.journal.Pending(); len(pending) != 0 {
+				t.Errorf("%d journal entries are left after the replay", len(pending))
+			}
+			if res := d.Get(volume.Request{Name: "data"}); res.Err == "" {
+				t.Errorf("interrupted volume exists after the replay: %v", res.Volume.Status)
+			}
+		})
+	}
+}
+
+func TestReplayDoesNotHoldUpStart(t *testing.T) {
+	e := newTestEnv(t)
+
+	hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer hung.Close()
+
+	// a create that was interrupted while its volume was being created
+	journal, err := NewJournal(e.metadataPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err := journal.Begin(OperationCreate, "data", testDatacenterId, testServerId)
+	if err == nil {
+		err = journal.Step(entry, StepCreateVolume)
+	}
+	if err == nil {
+		err = journal.Location(entry, hung.URL+"/requests/1/status")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	d := e.newDriver(0)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("driver started after %v", elapsed)
+	}
+
+	if res := d.Create(volume.Request{Name: "data"}); !strings.Contains(res.Err, "rolled back") {
+		t.Errorf("Create during the replay returned %q", res.Err)
+	}
+	if d.waitForBackground(100 * time.Millisecond) {
+		t.Error("replay of a create whose request hangs is done")
+	}
+
+	d.cancel()
+	if !d.waitForBackground(testWait) {
+		t.Fatalf("replay is still running after the driver was stopped")
+	}
+}
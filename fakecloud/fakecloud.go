@@ -0,0 +1,977 @@
+// Package fakecloud is an in-memory fake of the parts of the ProfitBricks
+// Cloud API v3 the volume driver uses: datacenters, servers, volumes,
+// attaching and detaching volumes, snapshots, images and request status.
+//
+// Changes are carried out asynchronously like in the real API. Every
+// request that changes something returns a Location header whose status
+// moves from QUEUED through RUNNING to DONE, or to FAILED if a fault was
+// injected, and the change only becomes visible once the request is done.
+// Volumes and snapshots are listed right away, but stay BUSY until the
+// request creating them is done; calls that change a BUSY volume or use a
+// BUSY snapshot are rejected, and a failed create removes them again.
+//
+// Volumes carry opaque data, set and read with SetVolumeData and
+// VolumeData, that is copied into snapshots and back by restores, so that
+// tests can tell which snapshot a volume was restored from.
+package fakecloud
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// BasePath is the path prefix of the API; point the SDK at
+	// http://<address>/cloudapi/v3.
+	BasePath = "/cloudapi/v3"
+
+	// FaultsPath accepts a JSON Fault with POST to inject it and DELETE to
+	// clear all faults, so scripts can inject faults into a running fake.
+	FaultsPath = "/_fake/faults"
+
+	// MaxServerVolumes is the number of volumes a server can have attached.
+	MaxServerVolumes = 24
+)
+
+const (
+	StateBusy      = "BUSY"
+	StateAvailable = "AVAILABLE"
+)
+
+const (
+	StatusQueued  = "QUEUED"
+	StatusRunning = "RUNNING"
+	StatusDone    = "DONE"
+	StatusFailed  = "FAILED"
+)
+
+// Config controls the timing of the fake.
+type Config struct {
+	// Latency delays every response.
+	Latency time.Duration
+	// QueueTime is how long a request stays QUEUED.
+	QueueTime time.Duration
+	// RunTime is how long a request stays RUNNING before it is DONE.
+	RunTime time.Duration
+}
+
+// Fault makes matching API calls fail. Method and Path select the calls;
+// an empty Method matches every method and Path matches any URL path
+// containing it. With StatusCode set the call is rejected with that HTTP
+// status, otherwise it is accepted and its request ends FAILED. A fault
+// applies Times times, or to every matching call if Times is 0.
+type Fault struct {
+	Method     string `json:"method"`
+	Path       string `json:"path"`
+	StatusCode int    `json:"statusCode"`
+	Message    string `json:"message"`
+	Times      int    `json:"times"`
+}
+
+// ParseFault parses a fault given as METHOD:PATH:STATUS[:TIMES], where
+// STATUS is an HTTP status code or FAILED, e.g. POST:/volumes:FAILED:1.
+func ParseFault(spec string) (Fault, error) {
+	fields := strings.Split(spec, ":")
+	if len(fields) < 3 || len(fields) > 4 {
+		return Fault{}, fmt.Errorf("invalid fault %q, expected METHOD:PATH:STATUS[:TIMES]", spec)
+	}
+
+	fault := Fault{Method: fields[0], Path: fields[1]}
+	if fault.Method == "*" {
+		fault.Method = ""
+	}
+	if !strings.EqualFold(fields[2], StatusFailed) {
+		status, err := strconv.Atoi(fields[2])
+		if err != nil || status < 400 || status > 599 {
+			return Fault{}, fmt.Errorf("invalid status %q in fault %q, expected an HTTP error status or %v", fields[2], spec, StatusFailed)
+		}
+		fault.StatusCode = status
+	}
+	if len(fields) == 4 {
+		times, err := strconv.Atoi(fields[3])
+		if err != nil || times < 0 {
+			return Fault{}, fmt.Errorf("invalid count %q in fault %q", fields[3], spec)
+		}
+		fault.Times = times
+	}
+	return fault, nil
+}
+
+// Server is the fake API. It implements http.Handler.
+type Server struct {
+	config Config
+	rand   *rand.Rand
+
+	m           sync.Mutex
+	datacenters map[string]*datacenter
+	snapshots   map[string]*snapshot
+	images      map[string]*image
+	requests    map[string]*request
+	faults      []*Fault
+}
+
+type datacenter struct {
+	id        string
+	servers   map[string]*server
+	volumes   map[string]*volume
+	attaching map[string]bool
+}
+
+type server struct {
+	id      string
+	volumes map[string]int64
+}
+
+type volume struct {
+	Id         string           `json:"id"`
+	Type       string           `json:"type"`
+	Href       string           `json:"href"`
+	Metadata   metadata         `json:"metadata"`
+	Properties volumeProperties `json:"properties"`
+
+	data string
+}
+
+type volumeProperties struct {
+	Name             string `json:"name,omitempty"`
+	Type             string `json:"type,omitempty"`
+	Size             int    `json:"size,omitempty"`
+	AvailabilityZone string `json:"availabilityZone,omitempty"`
+	Image            string `json:"image,omitempty"`
+	Bus              string `json:"bus,omitempty"`
+	LicenceType      string `json:"licenceType,omitempty"`
+	DeviceNumber     int64  `json:"deviceNumber,omitempty"`
+}
+
+type snapshot struct {
+	Id         string             `json:"id"`
+	Type       string             `json:"type"`
+	Href       string             `json:"href"`
+	Metadata   metadata           `json:"metadata"`
+	Properties snapshotProperties `json:"properties"`
+
+	data string
+}
+
+type snapshotProperties struct {
+	Name        string `json:"name,omitempty"`
+	Size        int    `json:"size,omitempty"`
+	LicenceType string `json:"licenceType,omitempty"`
+}
+
+type image struct {
+	Id         string          `json:"id"`
+	Type       string          `json:"type"`
+	Href       string          `json:"href"`
+	Properties imageProperties `json:"properties"`
+}
+
+type imageProperties struct {
+	Name        string `json:"name,omitempty"`
+	Size        int    `json:"size,omitempty"`
+	LicenceType string `json:"licenceType,omitempty"`
+}
+
+type metadata struct {
+	CreatedDate time.Time `json:"createdDate"`
+	State       string    `json:"state"`
+}
+
+type request struct {
+	id       string
+	created  time.Time
+	status   string
+	message  string
+	apply    func()
+	undo     func()
+	failed   bool
+	finished bool
+}
+
+func NewServer(config Config) *Server {
+	return &Server{
+		config:      config,
+		rand:        rand.New(rand.NewSource(time.Now().UnixNano())),
+		datacenters: make(map[string]*datacenter),
+		snapshots:   make(map[string]*snapshot),
+		images:      make(map[string]*image),
+		requests:    make(map[string]*request),
+	}
+}
+
+// AddDatacenter adds an empty datacenter.
+func (s *Server) AddDatacenter(id string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if _, ok := s.datacenters[id]; !ok {
+		s.datacenters[id] = &datacenter{
+			id:        id,
+			servers:   make(map[string]*server),
+			volumes:   make(map[string]*volume),
+			attaching: make(map[string]bool),
+		}
+	}
+}
+
+// AddServer adds a server without volumes to a datacenter, which is added
+// if it does not exist.
+func (s *Server) AddServer(datacenterId string, id string) {
+	s.AddDatacenter(datacenterId)
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	dc := s.datacenters[datacenterId]
+	if _, ok := dc.servers[id]; !ok {
+		dc.servers[id] = &server{id: id, volumes: make(map[string]int64)}
+	}
+}
+
+// AddImage adds an image volumes can be created from.
+func (s *Server) AddImage(id string, name string, size int) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.images[id] = &image{
+		Id:         id,
+		Type:       "image",
+		Href:       BasePath + "/images/" + id,
+		Properties: imageProperties{Name: name, Size: size, LicenceType: "OTHER"},
+	}
+}
+
+// Inject adds a fault. Faults are checked in the order they were added.
+func (s *Server) Inject(fault Fault) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	f := fault
+	s.faults = append(s.faults, &f)
+}
+
+// ClearFaults removes all faults.
+func (s *Server) ClearFaults() {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.faults = nil
+}
+
+// VolumeIds returns the IDs of the volumes of a datacenter, sorted.
+func (s *Server) VolumeIds(datacenterId string) []string {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	ids := []string{}
+	if dc, ok := s.datacenters[datacenterId]; ok {
+		for id := range dc.volumes {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// SetVolumeData sets the data of a volume.
+func (s *Server) SetVolumeData(datacenterId string, volumeId string, data string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	vol, err := s.lookupVolume(datacenterId, volumeId)
+	if err != nil {
+		return err
+	}
+	vol.data = data
+	return nil
+}
+
+// VolumeData returns the data of a volume.
+func (s *Server) VolumeData(datacenterId string, volumeId string) (string, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	vol, err := s.lookupVolume(datacenterId, volumeId)
+	if err != nil {
+		return "", err
+	}
+	return vol.data, nil
+}
+
+// VolumeSize returns the size of a volume in GB.
+func (s *Server) VolumeSize(datacenterId string, volumeId string) (int, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	vol, err := s.lookupVolume(datacenterId, volumeId)
+	if err != nil {
+		return 0, err
+	}
+	return vol.Properties.Size, nil
+}
+
+func (s *Server) lookupVolume(datacenterId string, volumeId string) (*volume, error) {
+	dc, ok := s.datacenters[datacenterId]
+	if !ok {
+		return nil, notFound("datacenter", datacenterId)
+	}
+	vol, ok := dc.volumes[volumeId]
+	if !ok {
+		return nil, notFound("volume", volumeId)
+	}
+	return vol, nil
+}
+
+// AttachedVolumeIds returns the IDs of the volumes attached to a server,
+// sorted.
+func (s *Server) AttachedVolumeIds(datacenterId string, serverId string) []string {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	ids := []string{}
+	if dc, ok := s.datacenters[datacenterId]; ok {
+		if srv, ok := dc.servers[serverId]; ok {
+			for id := range srv.volumes {
+				ids = append(ids, id)
+			}
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// apiError is the error body of the Cloud API.
+type apiError struct {
+	HTTPStatus int          `json:"httpStatus"`
+	Messages   []apiMessage `json:"messages"`
+}
+
+type apiMessage struct {
+	ErrorCode string `json:"errorCode"`
+	Message   string `json:"message"`
+}
+
+type collection struct {
+	Id    string        `json:"id"`
+	Type  string        `json:"type"`
+	Href  string        `json:"href"`
+	Items []interface{} `json:"items"`
+}
+
+type errorResponse struct {
+	status  int
+	message string
+}
+
+func (e *errorResponse) Error() string {
+	return e.message
+}
+
+func notFound(kind string, id string) error {
+	return &errorResponse{status: http.StatusNotFound, message: fmt.Sprintf("The requested %v '%v' does not exist", kind, id)}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.config.Latency > 0 {
+		time.Sleep(s.config.Latency)
+	}
+
+	if r.URL.Path == FaultsPath {
+		s.serveFaults(w, r)
+		return
+	}
+
+	if !strings.HasPrefix(r.URL.Path, BasePath+"/") {
+		writeError(w, &errorResponse{status: http.StatusNotFound, message: "unknown path " + r.URL.Path})
+		return
+	}
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, BasePath), "/"), "/")
+
+	body, _ := ioutil.ReadAll(r.Body)
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.advanceRequests()
+
+	fail := false
+	if fault := s.matchFault(r); fault != nil {
+		if fault.StatusCode != 0 {
+			writeError(w, &errorResponse{status: fault.StatusCode, message: fault.Message})
+			return
+		}
+		fail = true
+	}
+
+	result, req, err := s.route(r.Method, parts, body)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	status := http.StatusOK
+	if req != nil {
+		if fail {
+			req.failed = true
+			req.message = "injected failure"
+		}
+		w.Header().Set("Location", "http://"+r.Host+BasePath+"/requests/"+req.id+"/status")
+		status = http.StatusAccepted
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if result != nil {
+		json.NewEncoder(w).Encode(result)
+	}
+}
+
+func (s *Server) serveFaults(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		var fault Fault
+		err := json.NewDecoder(r.Body).Decode(&fault)
+		if err != nil {
+			writeError(w, &errorResponse{status: http.StatusBadRequest, message: err.Error()})
+			return
+		}
+		s.Inject(fault)
+	case "DELETE":
+		s.ClearFaults()
+	default:
+		writeError(w, &errorResponse{status: http.StatusMethodNotAllowed, message: r.Method + " is not supported on faults"})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) matchFault(r *http.Request) *Fault {
+	for i, fault := range s.faults {
+		if fault.Method != "" && !strings.EqualFold(fault.Method, r.Method) {
+			continue
+		}
+		if !strings.Contains(r.URL.Path, fault.Path) {
+			continue
+		}
+		if fault.Times > 0 {
+			fault.Times--
+			if fault.Times == 0 {
+				s.faults = append(s.faults[:i], s.faults[i+1:]...)
+			}
+		}
+		if fault.Message == "" {
+			fault.Message = "injected fault"
+		}
+		return fault
+	}
+	return nil
+}
+
+// route dispatches an API call. It returns the response body and, for
+// calls that change something, the request that carries the change out.
+func (s *Server) route(method string, parts []string, body []byte) (interface{}, *request, error) {
+	switch {
+	case len(parts) == 3 && parts[0] == "requests" && parts[2] == "status" && method == "GET":
+		return s.requestStatus(parts[1])
+
+	case len(parts) == 1 && parts[0] == "snapshots" && method == "GET":
+		return s.listSnapshots(), nil, nil
+	case len(parts) == 2 && parts[0] == "snapshots":
+		return s.snapshot(method, parts[1])
+
+	case len(parts) == 2 && parts[0] == "images" && method == "GET":
+		img, ok := s.images[parts[1]]
+		if !ok {
+			return nil, nil, notFound("image", parts[1])
+		}
+		return img, nil, nil
+
+	case len(parts) >= 2 && parts[0] == "datacenters":
+		dc, ok := s.datacenters[parts[1]]
+		if !ok {
+			return nil, nil, notFound("datacenter", parts[1])
+		}
+		return s.routeDatacenter(dc, method, parts[2:], body)
+	}
+	return nil, nil, &errorResponse{status: http.StatusNotFound, message: fmt.Sprintf("unknown call %v /%v", method, strings.Join(parts, "/"))}
+}
+
+func (s *Server) routeDatacenter(dc *datacenter, method string, parts []string, body []byte) (interface{}, *request, error) {
+	switch {
+	case len(parts) == 1 && parts[0] == "volumes" && method == "GET":
+		return s.listVolumes(dc), nil, nil
+	case len(parts) == 1 && parts[0] == "volumes" && method == "POST":
+		return s.createVolume(dc, body)
+	case len(parts) == 2 && parts[0] == "volumes":
+		return s.volume(dc, method, parts[1], body)
+	case len(parts) == 3 && parts[0] == "volumes" && method == "POST":
+		return s.volumeCommand(dc, parts[1], parts[2], body)
+
+	case len(parts) == 1 && parts[0] == "servers" && method == "GET":
+		return s.listServers(dc), nil, nil
+	case len(parts) >= 3 && parts[0] == "servers" && parts[2] == "volumes":
+		srv, ok := dc.servers[parts[1]]
+		if !ok {
+			return nil, nil, notFound("server", parts[1])
+		}
+		return s.serverVolumes(dc, srv, method, parts[3:], body)
+	}
+	return nil, nil, &errorResponse{status: http.StatusNotFound, message: fmt.Sprintf("unknown call %v on datacenter '%v'", method, dc.id)}
+}
+
+func (s *Server) listVolumes(dc *datacenter) interface{} {
+	items := []interface{}{}
+	for _, id := range sortedVolumeIds(dc.volumes) {
+		items = append(items, dc.volumes[id])
+	}
+	return collection{Id: dc.id + "/volumes", Type: "collection", Items: items}
+}
+
+func (s *Server) createVolume(dc *datacenter, body []byte) (interface{}, *request, error) {
+	var spec struct {
+		Properties volumeProperties `json:"properties"`
+	}
+	err := json.Unmarshal(body, &spec)
+	if err != nil {
+		return nil, nil, &errorResponse{status: http.StatusBadRequest, message: err.Error()}
+	}
+
+	props := spec.Properties
+	data := ""
+	if props.Image != "" {
+		size := 0
+		if img, ok := s.images[props.Image]; ok {
+			size = img.Properties.Size
+		} else if snap, ok := s.snapshots[props.Image]; ok {
+			if err := checkAvailable("snapshot", snap.Id, snap.Metadata); err != nil {
+				return nil, nil, err
+			}
+			size = snap.Properties.Size
+			data = snap.data
+		} else {
+			return nil, nil, &errorResponse{status: http.StatusUnprocessableEntity, message: fmt.Sprintf("image or snapshot '%v' does not exist", props.Image)}
+		}
+		if props.Size == 0 {
+			props.Size = size
+		}
+	}
+	if props.Size <= 0 {
+		return nil, nil, &errorResponse{status: http.StatusUnprocessableEntity, message: "the size of the volume is missing"}
+	}
+	if props.Type == "" {
+		props.Type = "HDD"
+	}
+	if props.Bus == "" {
+		props.Bus = "VIRTIO"
+	}
+	if props.AvailabilityZone == "" {
+		props.AvailabilityZone = "AUTO"
+	}
+
+	vol := &volume{
+		Id:         s.newId(),
+		Type:       "volume",
+		Metadata:   metadata{CreatedDate: time.Now().UTC(), State: StateBusy},
+		Properties: props,
+		data:       data,
+	}
+	vol.Href = BasePath + "/datacenters/" + dc.id + "/volumes/" + vol.Id
+	dc.volumes[vol.Id] = vol
+
+	req := s.newRequest(func() {
+		vol.Metadata.State = StateAvailable
+	})
+	req.undo = func() {
+		delete(dc.volumes, vol.Id)
+	}
+	return vol, req, nil
+}
+
+func (s *Server) volume(dc *datacenter, method string, id string, body []byte) (interface{}, *request, error) {
+	vol, ok := dc.volumes[id]
+	if !ok {
+		return nil, nil, notFound("volume", id)
+	}
+
+	if method != "GET" {
+		if err := checkAvailable("volume", id, vol.Metadata); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	switch method {
+	case "GET":
+		return vol, nil, nil
+
+	case "PATCH":
+		var changes volumeProperties
+		err := json.Unmarshal(body, &changes)
+		if err != nil {
+			return nil, nil, &errorResponse{status: http.StatusBadRequest, message: err.Error()}
+		}
+		if changes.Size != 0 && changes.Size < vol.Properties.Size {
+			return nil, nil, &errorResponse{status: http.StatusUnprocessableEntity, message: "volumes cannot be shrunk"}
+		}
+		req := s.newRequest(func() {
+			if changes.Name != "" {
+				vol.Properties.Name = changes.Name
+			}
+			if changes.Size != 0 {
+				vol.Properties.Size = changes.Size
+			}
+		})
+		return vol, req, nil
+
+	case "DELETE":
+		for _, srv := range dc.servers {
+			if _, ok := srv.volumes[id]; ok {
+				return nil, nil, &errorResponse{status: http.StatusUnprocessableEntity, message: fmt.Sprintf("volume '%v' is attached to server '%v'", id, srv.id)}
+			}
+		}
+		req := s.newRequest(func() {
+			delete(dc.volumes, id)
+		})
+		return nil, req, nil
+	}
+	return nil, nil, &errorResponse{status: http.StatusMethodNotAllowed, message: method + " is not supported on volumes"}
+}
+
+func (s *Server) volumeCommand(dc *datacenter, id string, command string, body []byte) (interface{}, *request, error) {
+	vol, ok := dc.volumes[id]
+	if !ok {
+		return nil, nil, notFound("volume", id)
+	}
+
+	if err := checkAvailable("volume", id, vol.Metadata); err != nil {
+		return nil, nil, err
+	}
+
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return nil, nil, &errorResponse{status: http.StatusBadRequest, message: err.Error()}
+	}
+
+	switch command {
+	case "create-snapshot":
+		snap := &snapshot{
+			Id:       s.newId(),
+			Type:     "snapshot",
+			Metadata: metadata{CreatedDate: time.Now().UTC(), State: StateBusy},
+			Properties: snapshotProperties{
+				Name:        form.Get("name"),
+				Size:        vol.Properties.Size,
+				LicenceType: vol.Properties.LicenceType,
+			},
+			data: vol.data,
+		}
+		snap.Href = BasePath + "/snapshots/" + snap.Id
+		s.snapshots[snap.Id] = snap
+
+		req := s.newRequest(func() {
+			snap.Metadata.State = StateAvailable
+		})
+		req.undo = func() {
+			delete(s.snapshots, snap.Id)
+		}
+		return snap, req, nil
+
+	case "restore-snapshot":
+		snapshotId := form.Get("snapshotId")
+		snap, ok := s.snapshots[snapshotId]
+		if !ok {
+			return nil, nil, notFound("snapshot", snapshotId)
+		}
+		if err := checkAvailable("snapshot", snapshotId, snap.Metadata); err != nil {
+			return nil, nil, err
+		}
+		for _, srv := range dc.servers {
+			if _, ok := srv.volumes[id]; ok {
+				return nil, nil, &errorResponse{status: http.StatusUnprocessableEntity, message: fmt.Sprintf("volume '%v' is attached to server '%v'", id, srv.id)}
+			}
+		}
+		if dc.attaching[id] {
+			return nil, nil, &errorResponse{status: http.StatusUnprocessableEntity, message: fmt.Sprintf("volume '%v' is being attached", id)}
+		}
+		if snap.Properties.Size > vol.Properties.Size {
+			return nil, nil, &errorResponse{status: http.StatusUnprocessableEntity, message: fmt.Sprintf("snapshot '%v' of %d GB does not fit into volume '%v' of %d GB", snapshotId, snap.Properties.Size, id, vol.Properties.Size)}
+		}
+		req := s.newRequest(func() {
+			vol.data = snap.data
+		})
+		return nil, req, nil
+	}
+	return nil, nil, &errorResponse{status: http.StatusNotFound, message: "unknown volume command " + command}
+}
+
+func (s *Server) listServers(dc *datacenter) interface{} {
+	ids := []string{}
+	for id := range dc.servers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	items := []interface{}{}
+	for _, id := range ids {
+		volumes := []interface{}{}
+		for _, volumeId := range sortedAttachedIds(dc.servers[id].volumes) {
+			if vol, ok := dc.volumes[volumeId]; ok {
+				volumes = append(volumes, vol)
+			}
+		}
+		items = append(items, map[string]interface{}{
+			"id":   id,
+			"type": "server",
+			"href": BasePath + "/datacenters/" + dc.id + "/servers/" + id,
+			"entities": map[string]interface{}{
+				"volumes": collection{Id: id + "/volumes", Type: "collection", Items: volumes},
+			},
+		})
+	}
+	return collection{Id: dc.id + "/servers", Type: "collection", Items: items}
+}
+
+func (s *Server) serverVolumes(dc *datacenter, srv *server, method string, parts []string, body []byte) (interface{}, *request, error) {
+	if len(parts) == 0 {
+		switch method {
+		case "GET":
+			items := []interface{}{}
+			for _, id := range sortedAttachedIds(srv.volumes) {
+				if vol, ok := dc.volumes[id]; ok {
+					items = append(items, s.attachedVolume(vol, srv))
+				}
+			}
+			return collection{Id: srv.id + "/volumes", Type: "collection", Items: items}, nil, nil
+
+		case "POST":
+			var ref struct {
+				Id string `json:"id"`
+			}
+			err := json.Unmarshal(body, &ref)
+			if err != nil {
+				return nil, nil, &errorResponse{status: http.StatusBadRequest, message: err.Error()}
+			}
+			vol, ok := dc.volumes[ref.Id]
+			if !ok {
+				return nil, nil, notFound("volume", ref.Id)
+			}
+			if err := checkAvailable("volume", ref.Id, vol.Metadata); err != nil {
+				return nil, nil, err
+			}
+			// a volume can only be attached once, even to the same server
+			for _, other := range dc.servers {
+				if _, ok := other.volumes[ref.Id]; ok {
+					return nil, nil, &errorResponse{status: http.StatusUnprocessableEntity, message: fmt.Sprintf("volume '%v' is already attached to server '%v'", ref.Id, other.id)}
+				}
+			}
+			if dc.attaching[ref.Id] {
+				return nil, nil, &errorResponse{status: http.StatusUnprocessableEntity, message: fmt.Sprintf("volume '%v' is already being attached", ref.Id)}
+			}
+			if len(srv.volumes) >= MaxServerVolumes {
+				return nil, nil, &errorResponse{status: http.StatusUnprocessableEntity, message: fmt.Sprintf("server '%v' already has %d volumes attached", srv.id, MaxServerVolumes)}
+			}
+
+			dc.attaching[ref.Id] = true
+			req := s.newRequest(func() {
+				delete(dc.attaching, ref.Id)
+				srv.volumes[ref.Id] = nextDeviceNumber(srv)
+			})
+			req.undo = func() {
+				delete(dc.attaching, ref.Id)
+			}
+			return vol, req, nil
+		}
+		return nil, nil, &errorResponse{status: http.StatusMethodNotAllowed, message: method + " is not supported on attached volumes"}
+	}
+
+	id := parts[0]
+	if _, ok := srv.volumes[id]; !ok {
+		return nil, nil, notFound("attached volume", id)
+	}
+	vol, ok := dc.volumes[id]
+	if !ok {
+		return nil, nil, notFound("volume", id)
+	}
+
+	switch method {
+	case "GET":
+		return s.attachedVolume(vol, srv), nil, nil
+	case "DELETE":
+		req := s.newRequest(func() {
+			delete(srv.volumes, id)
+		})
+		return nil, req, nil
+	}
+	return nil, nil, &errorResponse{status: http.StatusMethodNotAllowed, message: method + " is not supported on attached volumes"}
+}
+
+func (s *Server) attachedVolume(vol *volume, srv *server) *volume {
+	attached := *vol
+	attached.Properties.DeviceNumber = srv.volumes[vol.Id]
+	return &attached
+}
+
+func (s *Server) listSnapshots() interface{} {
+	ids := []string{}
+	for id := range s.snapshots {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	items := []interface{}{}
+	for _, id := range ids {
+		items = append(items, s.snapshots[id])
+	}
+	return collection{Id: "snapshots", Type: "collection", Items: items}
+}
+
+func (s *Server) snapshot(method string, id string) (interface{}, *request, error) {
+	snap, ok := s.snapshots[id]
+	if !ok {
+		return nil, nil, notFound("snapshot", id)
+	}
+
+	switch method {
+	case "GET":
+		return snap, nil, nil
+	case "DELETE":
+		if err := checkAvailable("snapshot", id, snap.Metadata); err != nil {
+			return nil, nil, err
+		}
+		req := s.newRequest(func() {
+			delete(s.snapshots, id)
+		})
+		return nil, req, nil
+	}
+	return nil, nil, &errorResponse{status: http.StatusMethodNotAllowed, message: method + " is not supported on snapshots"}
+}
+
+func (s *Server) requestStatus(id string) (interface{}, *request, error) {
+	req, ok := s.requests[id]
+	if !ok {
+		return nil, nil, notFound("request", id)
+	}
+
+	return map[string]interface{}{
+		"id":   id + "/status",
+		"type": "request-status",
+		"href": BasePath + "/requests/" + id + "/status",
+		"metadata": map[string]interface{}{
+			"status":  req.status,
+			"message": req.message,
+		},
+	}, nil, nil
+}
+
+// newRequest queues a request that applies the change once it is done.
+// If the request fails, its undo function is run instead, if it has one.
+func (s *Server) newRequest(apply func()) *request {
+	req := &request{
+		id:      s.newId(),
+		created: time.Now(),
+		status:  StatusQueued,
+		apply:   apply,
+	}
+	s.requests[req.id] = req
+	return req
+}
+
+// advanceRequests moves the requests along according to their age and
+// applies the changes of the ones that are done.
+func (s *Server) advanceRequests() {
+	now := time.Now()
+	for _, req := range s.requests {
+		if req.finished {
+			continue
+		}
+
+		age := now.Sub(req.created)
+		switch {
+		case age < s.config.QueueTime:
+			req.status = StatusQueued
+		case age < s.config.QueueTime+s.config.RunTime:
+			req.status = StatusRunning
+		default:
+			req.finished = true
+			if req.failed {
+				req.status = StatusFailed
+				if req.undo != nil {
+					req.undo()
+				}
+			} else {
+				req.status = StatusDone
+				req.apply()
+			}
+		}
+	}
+}
+
+// checkAvailable rejects calls on a volume or snapshot that is still BUSY
+// being created.
+func checkAvailable(kind string, id string, meta metadata) error {
+	if meta.State == StateBusy {
+		return &errorResponse{status: http.StatusUnprocessableEntity, message: fmt.Sprintf("The %v '%v' is busy", kind, id)}
+	}
+	return nil
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	if e, ok := err.(*errorResponse); ok {
+		status = e.status
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(apiError{
+		HTTPStatus: status,
+		Messages:   []apiMessage{{ErrorCode: fmt.Sprintf("%d", status), Message: err.Error()}},
+	})
+}
+
+func nextDeviceNumber(srv *server) int64 {
+	used := make(map[int64]bool)
+	for _, n := range srv.volumes {
+		used[n] = true
+	}
+	n := int64(1)
+	for used[n] {
+		n++
+	}
+	return n
+}
+
+func sortedVolumeIds(volumes map[string]*volume) []string {
+	ids := []string{}
+	for id := range volumes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func sortedAttachedIds(volumes map[string]int64) []string {
+	ids := []string{}
+	for id := range volumes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// newId returns a random UUID.
+func (s *Server) newId() string {
+	b := make([]byte, 16)
+	s.rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
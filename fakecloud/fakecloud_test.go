@@ -0,0 +1,303 @@
+package fakecloud
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testDatacenter = "dc"
+	testServer     = "server"
+)
+
+type testAPI struct {
+	t      *testing.T
+	server *Server
+	http   *httptest.Server
+}
+
+func newTestAPI(t *testing.T, config Config) *testAPI {
+	s := NewServer(config)
+	s.AddServer(testDatacenter, testServer)
+	s.AddServer(testDatacenter, "other")
+
+	api := &testAPI{t: t, server: s, http: httptest.NewServer(s)}
+	t.Cleanup(api.http.Close)
+	return api
+}
+
+// call sends a request to the fake and returns the status, the Location
+// header and the decoded body.
+func (a *testAPI) call(method string, path string, contentType string, body string) (int, string, map[string]interface{}) {
+	req, err := http.NewRequest(method, a.http.URL+BasePath+path, strings.NewReader(body))
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	result := map[string]interface{}{}
+	json.NewDecoder(res.Body).Decode(&result)
+	return res.StatusCode, res.Header.Get("Location"), result
+}
+
+// do sends a request that must be accepted and returns its body.
+func (a *testAPI) do(method string, path string, contentType string, body string) map[string]interface{} {
+	status, _, result := a.call(method, path, contentType, body)
+	if status >= 300 {
+		a.t.Fatalf("%v %v: status %d: %v", method, path, status, result)
+	}
+	return result
+}
+
+func (a *testAPI) createVolume(size int) string {
+	result := a.do("POST", "/datacenters/"+testDatacenter+"/volumes", "application/json", `{"properties": {"name": "test", "size": `+strconv.Itoa(size)+`}}`)
+	return result["id"].(string)
+}
+
+func (a *testAPI) attach(volumeId string) (int, map[string]interface{}) {
+	status, _, result := a.call("POST", "/datacenters/"+testDatacenter+"/servers/"+testServer+"/volumes", "application/json", `{"id": "`+volumeId+`"}`)
+	return status, result
+}
+
+func (a *testAPI) detach(volumeId string) {
+	a.do("DELETE", "/datacenters/"+testDatacenter+"/servers/"+testServer+"/volumes/"+volumeId, "", "")
+}
+
+func (a *testAPI) volumeCommand(volumeId string, command string, form url.Values) (int, map[string]interface{}) {
+	status, _, result := a.call("POST", "/datacenters/"+testDatacenter+"/volumes/"+volumeId+"/"+command, "application/x-www-form-urlencoded", form.Encode())
+	return status, result
+}
+
+// settle makes the fake apply the requests that are done.
+func (a *testAPI) settle() {
+	a.do("GET", "/datacenters/"+testDatacenter+"/volumes", "", "")
+}
+
+func TestRequestStatus(t *testing.T) {
+	api := newTestAPI(t, Config{QueueTime: 100 * time.Millisecond, RunTime: time.Hour})
+
+	_, location, _ := api.call("POST", "/datacenters/"+testDatacenter+"/volumes", "application/json", `{"properties": {"size": 10}}`)
+	if location == "" {
+		t.Fatal("no Location header for a volume create")
+	}
+	path := strings.TrimPrefix(location, api.http.URL+BasePath)
+
+	status := func() string {
+		result := api.do("GET", path, "", "")
+		return result["metadata"].(map[string]interface{})["status"].(string)
+	}
+
+	if got := status(); got != StatusQueued {
+		t.Errorf("new request is %v, want %v", got, StatusQueued)
+	}
+	time.Sleep(150 * time.Millisecond)
+	if got := status(); got != StatusRunning {
+		t.Errorf("request is %v, want %v", got, StatusRunning)
+	}
+}
+
+func TestFailedRequestIsUndone(t *testing.T) {
+	api := newTestAPI(t, Config{})
+	api.server.Inject(Fault{Method: "POST", Path: "/volumes", Times: 1})
+
+	api.createVolume(10)
+	api.settle()
+
+	if ids := api.server.VolumeIds(testDatacenter); len(ids) != 0 {
+		t.Errorf("volumes of a failed create are %v, want none", ids)
+	}
+}
+
+func TestAttachAttachedVolumeIsRejected(t *testing.T) {
+	api := newTestAPI(t, Config{})
+
+	volumeId := api.createVolume(10)
+	if status, result := api.attach(volumeId); status != http.StatusAccepted {
+		t.Fatalf("attach: status %d: %v", status, result)
+	}
+	api.settle()
+
+	if status, _ := api.attach(volumeId); status != http.StatusUnprocessableEntity {
+		t.Errorf("attaching an attached volume: status %d, want %d", status, http.StatusUnprocessableEntity)
+	}
+	if ids := api.server.AttachedVolumeIds(testDatacenter, testServer); len(ids) != 1 {
+		t.Errorf("attached volumes are %v, want one", ids)
+	}
+}
+
+func TestAttachVolumeBeingAttachedIsRejected(t *testing.T) {
+	api := newTestAPI(t, Config{RunTime: 500 * time.Millisecond})
+
+	volumeId := api.createVolume(10)
+	time.Sleep(600 * time.Millisecond)
+	api.settle()
+
+	if status, result := api.attach(volumeId); status != http.StatusAccepted {
+		t.Fatalf("attach: status %d: %v", status, result)
+	}
+	if status, _ := api.attach(volumeId); status != http.StatusUnprocessableEntity {
+		t.Errorf("attaching a volume that is being attached: status %d, want %d", status, http.StatusUnprocessableEntity)
+	}
+}
+
+func TestVolumeIsBusyUntilCreated(t *testing.T) {
+	api := newTestAPI(t, Config{RunTime: time.Hour})
+
+	volumeId := api.createVolume(10)
+	path := "/datacenters/" + testDatacenter + "/volumes/" + volumeId
+
+	result := api.do("GET", path, "", "")
+	if state := result["metadata"].(map[string]interface{})["state"]; state != StateBusy {
+		t.Errorf("volume being created is %v, want %v", state, StateBusy)
+	}
+
+	calls := map[string]func() int{
+		"attach": func() int {
+			status, _ := api.attach(volumeId)
+			return status
+		},
+		"resize": func() int {
+			status, _, _ := api.call("PATCH", path, "application/json", `{"size": 20}`)
+			return status
+		},
+		"delete": func() int {
+			status, _, _ := api.call("DELETE", path, "", "")
+			return status
+		},
+		"snapshot": func() int {
+			status, _ := api.volumeCommand(volumeId, "create-snapshot", url.Values{"name": {"snapshot"}})
+			return status
+		},
+	}
+	for name, call := range calls {
+		if status := call(); status != http.StatusUnprocessableEntity {
+			t.Errorf("%v of a volume being created: status %d, want %d", name, status, http.StatusUnprocessableEntity)
+		}
+	}
+}
+
+func TestAttachAfterFailedAttach(t *testing.T) {
+	api := newTestAPI(t, Config{})
+
+	volumeId := api.createVolume(10)
+	api.server.Inject(Fault{Method: "POST", Path: "/servers/", Times: 1})
+	api.attach(volumeId)
+	api.settle()
+
+	if status, result := api.attach(volumeId); status != http.StatusAccepted {
+		t.Fatalf("attach after a failed attach: status %d: %v", status, result)
+	}
+	api.settle()
+	if ids := api.server.AttachedVolumeIds(testDatacenter, testServer); len(ids) != 1 || ids[0] != volumeId {
+		t.Errorf("attached volumes are %v, want [%v]", ids, volumeId)
+	}
+}
+
+func TestRestoreSnapshot(t *testing.T) {
+	api := newTestAPI(t, Config{})
+
+	volumeId := api.createVolume(10)
+	api.settle()
+	if err := api.server.SetVolumeData(testDatacenter, volumeId, "before"); err != nil {
+		t.Fatal(err)
+	}
+
+	status, snapshot := api.volumeCommand(volumeId, "create-snapshot", url.Values{"name": {"snap"}})
+	if status != http.StatusAccepted {
+		t.Fatalf("create-snapshot: status %d: %v", status, snapshot)
+	}
+	snapshotId := snapshot["id"].(string)
+	api.settle()
+
+	api.server.SetVolumeData(testDatacenter, volumeId, "after")
+
+	status, result := api.volumeCommand(volumeId, "restore-snapshot", url.Values{"snapshotId": {snapshotId}})
+	if status != http.StatusAccepted {
+		t.Fatalf("restore-snapshot: status %d: %v", status, result)
+	}
+	api.settle()
+
+	data, err := api.server.VolumeData(testDatacenter, volumeId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data != "before" {
+		t.Errorf("restored volume has %q, want %q", data, "before")
+	}
+}
+
+func TestRestoreSnapshotOfAttachedVolumeIsRejected(t *testing.T) {
+	api := newTestAPI(t, Config{})
+
+	volumeId := api.createVolume(10)
+	_, snapshot := api.volumeCommand(volumeId, "create-snapshot", url.Values{"name": {"snap"}})
+	snapshotId := snapshot["id"].(string)
+	api.attach(volumeId)
+	api.settle()
+
+	if status, _ := api.volumeCommand(volumeId, "restore-snapshot", url.Values{"snapshotId": {snapshotId}}); status != http.StatusUnprocessableEntity {
+		t.Errorf("restoring an attached volume: status %d, want %d", status, http.StatusUnprocessableEntity)
+	}
+
+	api.detach(volumeId)
+	api.settle()
+	if status, result := api.volumeCommand(volumeId, "restore-snapshot", url.Values{"snapshotId": {snapshotId}}); status != http.StatusAccepted {
+		t.Errorf("restoring a detached volume: status %d: %v", status, result)
+	}
+}
+
+func TestVolumeFromSnapshotHasItsData(t *testing.T) {
+	api := newTestAPI(t, Config{})
+
+	volumeId := api.createVolume(10)
+	api.settle()
+	api.server.SetVolumeData(testDatacenter, volumeId, "data")
+	_, snapshot := api.volumeCommand(volumeId, "create-snapshot", url.Values{"name": {"snap"}})
+	api.settle()
+
+	result := api.do("POST", "/datacenters/"+testDatacenter+"/volumes", "application/json", `{"properties": {"image": "`+snapshot["id"].(string)+`"}}`)
+	api.settle()
+
+	data, _ := api.server.VolumeData(testDatacenter, result["id"].(string))
+	if data != "data" {
+		t.Errorf("volume created from a snapshot has %q, want %q", data, "data")
+	}
+}
+
+func TestParseFault(t *testing.T) {
+	fault, err := ParseFault("POST:/volumes:FAILED:2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fault != (Fault{Method: "POST", Path: "/volumes", Times: 2}) {
+		t.Errorf("ParseFault = %+v", fault)
+	}
+
+	fault, err = ParseFault("*:/servers:503")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fault != (Fault{Path: "/servers", StatusCode: 503}) {
+		t.Errorf("ParseFault = %+v", fault)
+	}
+
+	for _, spec := range []string{"POST:/volumes", "POST:/volumes:200", "POST:/volumes:FAILED:x"} {
+		if _, err := ParseFault(spec); err == nil {
+			t.Errorf("ParseFault(%q) succeeded", spec)
+		}
+	}
+}
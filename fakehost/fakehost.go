@@ -0,0 +1,607 @@
+// Package fakehost is an in-memory fake of the host the volume driver runs
+// on. It implements the driver's HostUtilities: devices show up for
+// attached volumes, filesystems are created, checked and grown, and
+// mounts are tracked, without touching the machine. Only the mount points
+// are real; they have to exist as directories like for mount(8).
+//
+// Devices are added with AttachDevice, or follow the volumes reported by
+// Config.Attached to run the driver against a fake cloud. Faults make
+// single operations fail.
+package fakehost
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PollInterval is how often ResolveDevice and RescanDevice look at the
+// devices while they wait.
+const PollInterval = 10 * time.Millisecond
+
+// The operations faults can be injected into.
+const (
+	OpResolve = "resolve"
+	OpRescan  = "rescan"
+	OpMount   = "mount"
+	OpUnmount = "umount"
+	OpFormat  = "mkfs"
+	OpGrow    = "grow"
+	OpCheck   = "check"
+	OpProbe   = "probe"
+)
+
+// Filesystems are the filesystems that can be created.
+var Filesystems = []string{"ext4", "xfs", "btrfs"}
+
+// Config controls the fake.
+type Config struct {
+	// ServerId is returned by GetServerId.
+	ServerId string
+	// DeviceDelay is how long a device takes to show up after its volume
+	// was attached.
+	DeviceDelay time.Duration
+	// Attached returns the IDs of the volumes attached to the server. When
+	// set, devices appear for attached volumes and disappear once their
+	// volume is detached.
+	Attached func() []string
+	// VolumeSize returns the size in GB of a volume in the cloud. When set,
+	// devices have the size of their volume and only grow when they are
+	// rescanned after their volume was grown. Otherwise devices keep the
+	// size they were attached with until ResizeVolume is called.
+	VolumeSize func(volumeId string) int
+}
+
+// Fault makes operations fail. Op selects the operation and Target
+// matches the device or mount point it is applied to if the argument
+// contains it; empty fields match everything. A fault applies Times times,
+// or to every matching operation if Times is 0.
+type Fault struct {
+	Op      string
+	Target  string
+	Message string
+	Times   int
+}
+
+// Device describes a device of the fake host. Sizes are in GB.
+type Device struct {
+	Path           string
+	VolumeId       string
+	Size           int
+	Filesystem     string
+	FilesystemSize int
+	MountPoint     string
+	MountOptions   string
+	Usage          int
+}
+
+// Host is the fake host. It is safe for concurrent use.
+type Host struct {
+	config Config
+
+	m       sync.Mutex
+	devices map[string]*device
+	faults  []*Fault
+}
+
+type device struct {
+	Device
+	appearsAt time.Time
+	// volumeSize is the size of the volume behind the device, which the
+	// device takes when it is rescanned
+	volumeSize int
+}
+
+func NewHost(config Config) *Host {
+	return &Host{
+		config:  config,
+		devices: make(map[string]*device),
+	}
+}
+
+// AttachDevice adds a device of the given size for the volume, which shows
+// up after the configured delay, and returns its path. Attaching a volume
+// that already has a device returns the existing one.
+func (h *Host) AttachDevice(volumeId string, sizeGB int) string {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	return h.attach(volumeId, sizeGB).Path
+}
+
+// ResizeVolume grows the volume behind a device added with AttachDevice,
+// like the cloud does. The device takes the new size when it is rescanned.
+func (h *Host) ResizeVolume(volumeId string, sizeGB int) error {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	dev := h.byVolume(volumeId)
+	if dev == nil {
+		return fmt.Errorf("no device with serial '%v' found", volumeId)
+	}
+	dev.volumeSize = sizeGB
+	return nil
+}
+
+// DetachDevice removes the device of the volume, like the kernel does when
+// the volume is detached, even if it is still mounted.
+func (h *Host) DetachDevice(volumeId string) {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	if dev := h.byVolume(volumeId); dev != nil {
+		delete(h.devices, dev.Path)
+	}
+}
+
+// Devices returns the devices that have shown up, sorted by path.
+func (h *Host) Devices() []Device {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	h.sync()
+	devices := []Device{}
+	for _, dev := range h.devices {
+		if dev.present() {
+			devices = append(devices, dev.Device)
+		}
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].Path < devices[j].Path })
+	return devices
+}
+
+// SetFilesystem puts a filesystem on a device as if it had been created
+// elsewhere, or wipes it if filesystem is empty.
+func (h *Host) SetFilesystem(path string, filesystem string) error {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	dev, err := h.device(path)
+	if err != nil {
+		return err
+	}
+	dev.Filesystem = filesystem
+	dev.FilesystemSize = dev.Size
+	dev.Usage = 0
+	return nil
+}
+
+// SetUsage sets how much of the filesystem on a device is used, in
+// percent, as reported by FilesystemUsage.
+func (h *Host) SetUsage(path string, percent int) error {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	dev, err := h.device(path)
+	if err != nil {
+		return err
+	}
+	dev.Usage = percent
+	return nil
+}
+
+// Inject adds a fault. Faults are checked in the order they were added.
+func (h *Host) Inject(fault Fault) {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	f := fault
+	h.faults = append(h.faults, &f)
+}
+
+// ClearFaults removes all faults.
+func (h *Host) ClearFaults() {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	h.faults = nil
+}
+
+func (h *Host) GetServerId() (string, error) {
+	return h.config.ServerId, nil
+}
+
+// ResolveDevice waits until the device of the volume shows up and has at
+// least the given size.
+func (h *Host) ResolveDevice(volumeId string, deviceNumber int64, bus string, sizeGB int, timeout time.Duration) (string, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		path, err := h.resolve(volumeId, sizeGB)
+		if err == nil {
+			return path, nil
+		}
+		if _, ok := err.(*faultError); ok || time.Now().After(deadline) {
+			return "", fmt.Errorf("no device found for volume '%v' after %v: %v", volumeId, timeout, err)
+		}
+		time.Sleep(PollInterval)
+	}
+}
+
+func (h *Host) resolve(volumeId string, sizeGB int) (string, error) {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	if err := h.fault(OpResolve, volumeId); err != nil {
+		return "", err
+	}
+	h.sync()
+	dev := h.byVolume(volumeId)
+	if dev == nil || !dev.present() {
+		return "", fmt.Errorf("no device with serial '%v' found", volumeId)
+	}
+	if dev.Size == 0 {
+		dev.Size = sizeGB
+		dev.volumeSize = sizeGB
+	}
+	if dev.Size < sizeGB {
+		return "", fmt.Errorf("device '%v' has %d GB, expected at least %d", dev.Path, dev.Size, sizeGB)
+	}
+	if dev.MountPoint != "" {
+		return "", fmt.Errorf("device '%v' is mounted on '%v'", dev.Path, dev.MountPoint)
+	}
+	return dev.Path, nil
+}
+
+// ResolveMountedDevice returns the device of the volume if it is mounted on
+// the mount point.
+func (h *Host) ResolveMountedDevice(volumeId string, deviceNumber int64, bus string, mountPoint string) (string, error) {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	if err := h.fault(OpResolve, volumeId); err != nil {
+		return "", err
+	}
+	h.sync()
+	dev := h.byVolume(volumeId)
+	if dev == nil || !dev.present() {
+		return "", fmt.Errorf("no device with serial '%v' found", volumeId)
+	}
+	if dev.MountPoint != mountPoint {
+		return "", fmt.Errorf("device '%v' of volume '%v' is not mounted on '%v'", dev.Path, volumeId, mountPoint)
+	}
+	return dev.Path, nil
+}
+
+// RescanDevice makes the device take the size of its volume and waits
+// until it has at least the given size.
+func (h *Host) RescanDevice(path string, sizeGB int, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		size, err := h.rescan(path)
+		if err != nil {
+			return err
+		}
+		if size >= sizeGB {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("device '%v' still has %d GB after %v, expected at least %d", path, size, timeout, sizeGB)
+		}
+		time.Sleep(PollInterval)
+	}
+}
+
+func (h *Host) rescan(path string) (int, error) {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	if err := h.fault(OpRescan, path); err != nil {
+		return 0, err
+	}
+	dev, err := h.device(path)
+	if err != nil {
+		return 0, err
+	}
+	if size := h.volumeSize(dev); size > dev.Size {
+		dev.Size = size
+	}
+	return dev.Size, nil
+}
+
+func (h *Host) DeviceSize(path string) (int, error) {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	dev, err := h.device(path)
+	if err != nil {
+		return 0, err
+	}
+	return dev.Size, nil
+}
+
+func (h *Host) MountVolume(path string, mountPoint string, filesystem string, mountOptions string) error {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	if err := h.fault(OpMount, path, mountPoint); err != nil {
+		return err
+	}
+	dev, err := h.device(path)
+	if err != nil {
+		return fmt.Errorf("mount: special device %v does not exist", path)
+	}
+	if dev.Filesystem == "" || dev.Filesystem != filesystem {
+		return fmt.Errorf("mount: wrong fs type, bad option, bad superblock on %v", path)
+	}
+	if info, err := os.Stat(mountPoint); err != nil || !info.IsDir() {
+		return fmt.Errorf("mount: mount point %v does not exist", mountPoint)
+	}
+	if dev.MountPoint != "" {
+		return fmt.Errorf("mount: %v is already mounted on %v", path, dev.MountPoint)
+	}
+	if other := h.mountedOn(mountPoint); other != nil {
+		return fmt.Errorf("mount: %v is already mounted on %v", other.Path, mountPoint)
+	}
+
+	dev.MountPoint = mountPoint
+	dev.MountOptions = mountOptions
+	return nil
+}
+
+func (h *Host) UnmountVolume(mountPoint string) error {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	if err := h.fault(OpUnmount, mountPoint); err != nil {
+		return err
+	}
+	dev := h.mountedOn(mountPoint)
+	if dev == nil {
+		return fmt.Errorf("umount: %v: not mounted", mountPoint)
+	}
+	dev.MountPoint = ""
+	dev.MountOptions = ""
+	return nil
+}
+
+func (h *Host) IsMounted(mountPoint string) (bool, error) {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	return h.mountedOn(mountPoint) != nil, nil
+}
+
+func (h *Host) FilesystemUsage(mountPoint string) (int, error) {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	dev := h.mountedOn(mountPoint)
+	if dev == nil {
+		return 0, fmt.Errorf("nothing is mounted on '%v'", mountPoint)
+	}
+	return dev.Usage, nil
+}
+
+func (h *Host) FormatVolume(path string, filesystem string, mkfsOptions string, force bool) error {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	if err := h.fault(OpFormat, path); err != nil {
+		return err
+	}
+	if !supported(filesystem) {
+		return fmt.Errorf("mkfs.%v: command not found", filesystem)
+	}
+	dev, err := h.device(path)
+	if err != nil {
+		return err
+	}
+	if dev.MountPoint != "" {
+		return fmt.Errorf("%v is mounted; will not make a filesystem here", path)
+	}
+	if dev.Filesystem != "" && !force {
+		return fmt.Errorf("%v contains a %v file system", path, dev.Filesystem)
+	}
+
+	dev.Filesystem = filesystem
+	dev.FilesystemSize = dev.Size
+	dev.Usage = 0
+	return nil
+}
+
+func (h *Host) GrowFilesystem(path string, mountPoint string, filesystem string) error {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	if err := h.fault(OpGrow, path); err != nil {
+		return err
+	}
+	if !supported(filesystem) {
+		return fmt.Errorf("growing %v filesystems is not supported", filesystem)
+	}
+	dev, err := h.device(path)
+	if err != nil {
+		return err
+	}
+	if dev.Filesystem != filesystem {
+		return fmt.Errorf("failed to grow '%v': it contains a %q filesystem, not %v", path, dev.Filesystem, filesystem)
+	}
+	if dev.FilesystemSize > 0 {
+		dev.Usage = dev.Usage * dev.FilesystemSize / dev.Size
+	}
+	dev.FilesystemSize = dev.Size
+	return nil
+}
+
+func (h *Host) CheckFilesystem(path string, filesystem string) error {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	err := h.fault(OpCheck, path)
+	if err == nil {
+		var dev *device
+		dev, err = h.device(path)
+		if err == nil && dev.Filesystem != filesystem {
+			err = fmt.Errorf("no %v filesystem found", filesystem)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("the %v filesystem on '%v' is not consistent: %v", filesystem, path, err)
+	}
+	return nil
+}
+
+func (h *Host) GetFilesystem(path string) (string, error) {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	if err := h.fault(OpProbe, path); err != nil {
+		return "", fmt.Errorf("failed to probe '%v': %v", path, err)
+	}
+	dev, err := h.device(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to probe '%v': %v", path, err)
+	}
+	return dev.Filesystem, nil
+}
+
+// attach adds the device of a volume if it has none yet. Devices are named
+// like virtio disks, starting with vdb.
+func (h *Host) attach(volumeId string, sizeGB int) *device {
+	if dev := h.byVolume(volumeId); dev != nil {
+		return dev
+	}
+
+	var path string
+	for index := 1; ; index++ {
+		path = diskName(index)
+		if _, ok := h.devices[path]; !ok {
+			break
+		}
+	}
+
+	dev := &device{
+		Device:     Device{Path: path, VolumeId: volumeId, Size: sizeGB},
+		appearsAt:  time.Now().Add(h.config.DeviceDelay),
+		volumeSize: sizeGB,
+	}
+	if size := h.volumeSize(dev); size > 0 {
+		dev.Size = size
+	}
+	h.devices[path] = dev
+	return dev
+}
+
+// sync adds and removes devices to match the attached volumes if
+// Config.Attached is set. New devices have the size of their volume if
+// Config.VolumeSize is set, otherwise they are given their size when they
+// are resolved.
+func (h *Host) sync() {
+	if h.config.Attached == nil {
+		return
+	}
+
+	attached := make(map[string]bool)
+	for _, volumeId := range h.config.Attached() {
+		attached[volumeId] = true
+		h.attach(volumeId, 0)
+	}
+	for path, dev := range h.devices {
+		if !attached[dev.VolumeId] {
+			delete(h.devices, path)
+		}
+	}
+}
+
+// device returns the device at the path if it has shown up.
+func (h *Host) device(path string) (*device, error) {
+	h.sync()
+	dev, ok := h.devices[path]
+	if !ok || !dev.present() {
+		return nil, fmt.Errorf("device '%v' does not exist", path)
+	}
+	return dev, nil
+}
+
+// volumeSize returns the size of the volume behind the device.
+func (h *Host) volumeSize(dev *device) int {
+	if h.config.VolumeSize != nil {
+		return h.config.VolumeSize(dev.VolumeId)
+	}
+	return dev.volumeSize
+}
+
+func (h *Host) byVolume(volumeId string) *device {
+	for _, dev := range h.devices {
+		if dev.VolumeId == volumeId {
+			return dev
+		}
+	}
+	return nil
+}
+
+func (h *Host) mountedOn(mountPoint string) *device {
+	for _, dev := range h.devices {
+		if dev.MountPoint == mountPoint {
+			return dev
+		}
+	}
+	return nil
+}
+
+func (h *Host) fault(op string, targets ...string) error {
+	for i, fault := range h.faults {
+		if fault.Op != "" && fault.Op != op {
+			continue
+		}
+		if fault.Target != "" && !contains(targets, fault.Target) {
+			continue
+		}
+		if fault.Times > 0 {
+			fault.Times--
+			if fault.Times == 0 {
+				h.faults = append(h.faults[:i], h.faults[i+1:]...)
+			}
+		}
+		message := fault.Message
+		if message == "" {
+			message = "injected fault"
+		}
+		return &faultError{op: op, message: message}
+	}
+	return nil
+}
+
+type faultError struct {
+	op      string
+	message string
+}
+
+func (e *faultError) Error() string {
+	return e.op + ": " + e.message
+}
+
+func (d *device) present() bool {
+	return !time.Now().Before(d.appearsAt)
+}
+
+func contains(targets []string, target string) bool {
+	for _, t := range targets {
+		if strings.Contains(t, target) {
+			return true
+		}
+	}
+	return false
+}
+
+func supported(filesystem string) bool {
+	for _, fs := range Filesystems {
+		if fs == filesystem {
+			return true
+		}
+	}
+	return false
+}
+
+// diskName returns the name the kernel gives the virtio disk with the
+// index: vda, vdb, ..., vdz, vdaa and so on.
+func diskName(index int) string {
+	name := ""
+	for ; index >= 0; index = index/26 - 1 {
+		name = string(rune('a'+index%26)) + name
+	}
+	return "/dev/vd" + name
+}
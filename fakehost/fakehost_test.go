@@ -0,0 +1,56 @@
+package fakehost
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRescanDeviceTakesVolumeSize(t *testing.T) {
+	h := NewHost(Config{})
+	path := h.AttachDevice("volume", 5)
+
+	if err := h.RescanDevice(path, 5, 0); err != nil {
+		t.Fatalf("RescanDevice of an unchanged device failed: %v", err)
+	}
+
+	// the device does not grow unless its volume was grown
+	if err := h.RescanDevice(path, 10, 50*time.Millisecond); err == nil {
+		t.Fatal("RescanDevice grew a device whose volume was not grown")
+	}
+	if size, _ := h.DeviceSize(path); size != 5 {
+		t.Fatalf("device has %d GB, want 5", size)
+	}
+
+	if err := h.ResizeVolume("volume", 20); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.RescanDevice(path, 10, 0); err != nil {
+		t.Fatalf("RescanDevice of a device grown beyond the size failed: %v", err)
+	}
+	if size, _ := h.DeviceSize(path); size != 20 {
+		t.Errorf("device has %d GB, want 20", size)
+	}
+}
+
+func TestRescanDeviceFollowsCloud(t *testing.T) {
+	size := 5
+	h := NewHost(Config{
+		Attached:   func() []string { return []string{"volume"} },
+		VolumeSize: func(volumeId string) int { return size },
+	})
+	path, err := h.ResolveDevice("volume", 1, "VIRTIO", 5, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	size = 10
+	if got, _ := h.DeviceSize(path); got != 5 {
+		t.Fatalf("device has %d GB before it was rescanned, want 5", got)
+	}
+	if err := h.RescanDevice(path, 10, 0); err != nil {
+		t.Fatalf("RescanDevice failed: %v", err)
+	}
+	if got, _ := h.DeviceSize(path); got != 10 {
+		t.Errorf("device has %d GB, want 10", got)
+	}
+}
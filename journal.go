@@ -0,0 +1,356 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	JournalDir = "journal"
+
+	OperationCreate = "create"
+	OperationRemove = "remove"
+
+	StepCreateVolume = "create-volume"
+	StepAttachVolume = "attach-volume"
+	StepClaimVolume  = "claim-volume"
+	StepMakeMountDir = "make-mount-dir"
+	StepFormat       = "format"
+	StepSaveMetadata = "save-metadata"
+	StepDetachVolume = "detach-volume"
+	StepDeleteVolume = "delete-volume"
+)
+
+// Journal is a write-ahead log of the steps of Create and Remove. Every
+// operation has its own file under the journal directory that is written
+// before each step is started and again once the ProfitBricks request of
+// the step is known and done. The file is removed when the operation
+// completes, so any file found at startup belongs to an interrupted
+// operation.
+type Journal struct {
+	path string
+}
+
+// JournalEntry is the journal record of a single operation.
+type JournalEntry struct {
+	Id           string        `json:"id"`
+	Operation    string        `json:"operation"`
+	Volume       string        `json:"volume"`
+	VolumeId     string        `json:"volumeId,omitempty"`
+	DatacenterId string        `json:"datacenterId"`
+	ServerId     string        `json:"serverId"`
+	MountPoint   string        `json:"mountPoint,omitempty"`
+	Steps        []JournalStep `json:"steps"`
+	StartedAt    time.Time     `json:"startedAt"`
+}
+
+// JournalStep is a step of an operation and the ProfitBricks request that
+// carries it out.
+type JournalStep struct {
+	Name     string    `json:"name"`
+	Location string    `json:"location,omitempty"`
+	Done     bool      `json:"done"`
+	Time     time.Time `json:"time"`
+}
+
+func NewJournal(metadataPath string) (*Journal, error) {
+	path := filepath.Join(metadataPath, JournalDir)
+	err := os.MkdirAll(path, MetadataDirMode)
+	if err != nil {
+		return nil, err
+	}
+	return &Journal{path: path}, nil
+}
+
+// Begin records the start of an operation on a volume.
+func (j *Journal) Begin(operation string, name string, datacenterId string, serverId string) (*JournalEntry, error) {
+	now := time.Now().UTC()
+	e := &JournalEntry{
+		Id:           fmt.Sprintf("%d-%s-%s", now.UnixNano(), operation, name),
+		Operation:    operation,
+		Volume:       name,
+		DatacenterId: datacenterId,
+		ServerId:     serverId,
+		StartedAt:    now,
+	}
+	return e, j.save(e)
+}
+
+// Step records that the named step is about to start.
+func (j *Journal) Step(e *JournalEntry, name string) error {
+	e.Steps = append(e.Steps, JournalStep{Name: name, Time: time.Now().UTC()})
+	return j.save(e)
+}
+
+// Location records the request location of the current step.
+func (j *Journal) Location(e *JournalEntry, location string) error {
+	e.Steps[len(e.Steps)-1].Location = location
+	return j.save(e)
+}
+
+// Done records that the current step completed.
+func (j *Journal) Done(e *JournalEntry) error {
+	step := &e.Steps[len(e.Steps)-1]
+	step.Done = true
+	step.Time = time.Now().UTC()
+	return j.save(e)
+}
+
+// Finish removes the record of a completed or rolled back operation.
+func (j *Journal) Finish(e *JournalEntry) error {
+	err := os.Remove(j.entryPath(e))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Pending returns the operations that were interrupted, oldest first.
+func (j *Journal) Pending() ([]*JournalEntry, error) {
+	files, err := ioutil.ReadDir(j.path)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []*JournalEntry{}
+	for _, file := range files {
+		if file.IsDir() || strings.HasPrefix(file.Name(), ".") || !strings.HasSuffix(file.Name(), MetadataFileExtension) {
+			continue
+		}
+
+		path := filepath.Join(j.path, file.Name())
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.Errorf("failed to read journal file '%v': %v", path, err)
+			continue
+		}
+
+		e := &JournalEntry{}
+		err = json.Unmarshal(data, e)
+		if err != nil {
+			log.Errorf("failed to parse journal file '%v': %v", path, err)
+			continue
+		}
+		entries = append(entries, e)
+	}
+
+	sort.Sort(entriesByStart(entries))
+	return entries, nil
+}
+
+// replayJournal finishes the removes that were interrupted by a crash or
+// reboot and returns the interrupted creates, which are rolled back in the
+// background by replayCreates. Removes are finished before the driver
+// starts, as the volume must not be used in the meantime. Operations that
+// cannot be replayed are kept and retried at the next start.
+func (d *Driver) replayJournal() []*JournalEntry {
+	entries, err := d.journal.Pending()
+	if err != nil {
+		log.Errorf("failed to read the journal: %v", err)
+		return nil
+	}
+
+	creates := []*JournalEntry{}
+	for _, e := range entries {
+		log.Warnf("replaying interrupted %v of volume '%v' started at %v", e.Operation, e.Volume, e.StartedAt)
+
+		switch e.Operation {
+		case OperationCreate:
+			// tracked like a create that is provisioned, so that mounts
+			// wait for it and shutdown lets it finish
+			if !d.isProvisioning(e.Volume) {
+				d.startProvisioning(e.Volume)
+			}
+			creates = append(creates, e)
+			continue
+		case OperationRemove:
+			err = d.finishRemove(e)
+		default:
+			err = fmt.Errorf("unknown operation %q", e.Operation)
+		}
+
+		if err != nil {
+			log.Errorf("failed to replay %v of volume '%v': %v", e.Operation, e.Volume, err)
+		}
+	}
+
+	// nothing is provisioned in the background yet, so a volume still
+	// provisioning without a create to replay was interrupted after its
+	// journal was finished
+	for _, name := range d.volumeNames() {
+		if d.isProvisioning(name) {
+			continue
+		}
+		if state, ok := d.lookupVolume(name); ok && state.Status == VolumeStatusProvisioning {
+			d.markProvisioningFailed(name, fmt.Errorf("provisioning of volume '%v' was interrupted", name))
+		}
+	}
+	return creates
+}
+
+// replayCreates rolls back the interrupted creates in the background, one
+// goroutine per volume, so that waiting for their requests does not hold
+// up the start of the driver.
+func (d *Driver) replayCreates(creates []*JournalEntry) {
+	byVolume := make(map[string][]*JournalEntry)
+	for _, e := range creates {
+		byVolume[e.Volume] = append(byVolume[e.Volume], e)
+	}
+
+	for name, entries := range byVolume {
+		go func(name string, entries []*JournalEntry) {
+			defer d.provisioned(name)
+
+			for _, e := range entries {
+				err := d.replayCreate(e)
+				if err != nil {
+					log.Errorf("failed to replay %v of volume '%v': %v", e.Operation, e.Volume, err)
+				}
+			}
+		}(name, entries)
+	}
+}
+
+func (d *Driver) replayCreate(e *JournalEntry) error {
+	if e.VolumeId != "" && d.recordedVolumeId(e.Volume) == e.VolumeId {
+		log.Infof("create of volume '%v' completed before it was interrupted", e.Volume)
+		return d.journal.Finish(e)
+	}
+
+	// let a request that was still running finish before touching the volume
+	if n := len(e.Steps); n > 0 && !e.Steps[n-1].Done && e.Steps[n-1].Location != "" {
+		err := d.provider.Wait(d.ctx, e.Steps[n-1].Location)
+		if err != nil {
+			log.Warnf("interrupted %v request of volume '%v' did not complete: %v", e.Steps[n-1].Name, e.Volume, err)
+		}
+	}
+
+	volumeId := e.VolumeId
+	if volumeId == "" && e.step(StepCreateVolume) != nil {
+		var err error
+		volumeId, err = d.findOrphanedVolume(e)
+		if err != nil {
+			return err
+		}
+	}
+
+	if volumeId != "" && e.step(StepClaimVolume) != nil {
+		// a pool volume that was never renamed is left to the pool
+		vol, err := d.provider.GetVolume(e.DatacenterId, volumeId)
+		if err == nil && strings.HasPrefix(vol.Name, PoolVolumePrefix) {
+			log.Infof("pool volume '%v' was not claimed by volume '%v' yet, keeping it", volumeId, e.Volume)
+			volumeId = ""
+		}
+	}
+
+	var undo rollback
+	if volumeId != "" {
+		undo.add(fmt.Sprintf("delete volume '%v'", volumeId), func() error {
+			return d.deleteVolume(e.DatacenterId, volumeId)
+		})
+		// claimed pool volumes are attached already
+		if e.step(StepAttachVolume) != nil || e.step(StepClaimVolume) != nil {
+			undo.add(fmt.Sprintf("detach volume '%v'", volumeId), func() error {
+				return d.detachVolume(e.DatacenterId, e.ServerId, volumeId)
+			})
+		}
+	}
+	if e.step(StepMakeMountDir) != nil && e.MountPoint != "" {
+		undo.add(fmt.Sprintf("remove mount point '%v'", e.MountPoint), func() error {
+			err := os.Remove(e.MountPoint)
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		})
+	}
+
+	err := undo.run(fmt.Errorf("create of volume '%v' was interrupted", e.Volume))
+	d.markProvisioningFailed(e.Volume, err)
+	if undo.failed {
+		return err
+	}
+	log.Warn(err.Error())
+	return d.journal.Finish(e)
+}
+
+// findOrphanedVolume looks for the cloud volume of an interrupted create
+// whose ID was never recorded, by the name the driver gave it.
+func (d *Driver) findOrphanedVolume(e *JournalEntry) (string, error) {
+	all, err := d.provider.ListVolumes(e.DatacenterId)
+	if err != nil {
+		return "", fmt.Errorf("failed to list volumes of datacenter '%v': %v", e.DatacenterId, err)
+	}
+
+	known := make(map[string]bool)
+	for _, name := range d.volumeNames() {
+		known[d.recordedVolumeId(name)] = true
+	}
+
+	found := []string{}
+	for _, vol := range all {
+		if vol.Name == VolumeNamePrefix+e.Volume && !known[vol.Id] {
+			found = append(found, vol.Id)
+		}
+	}
+
+	switch len(found) {
+	case 0:
+		return "", nil
+	case 1:
+		return found[0], nil
+	default:
+		return "", fmt.Errorf("found %d cloud volumes named '%v%v', remove the orphaned ones manually", len(found), VolumeNamePrefix, e.Volume)
+	}
+}
+
+// recordedVolumeId returns the ID of the cloud volume recorded for the
+// named volume, if any.
+func (d *Driver) recordedVolumeId(name string) string {
+	defer d.locks.lock(name)()
+
+	state, ok := d.lookupVolume(name)
+	if !ok {
+		return ""
+	}
+	return state.VolumeId
+}
+
+// step returns the last record of the named step, if it was started.
+func (e *JournalEntry) step(name string) *JournalStep {
+	for i := len(e.Steps) - 1; i >= 0; i-- {
+		if e.Steps[i].Name == name {
+			return &e.Steps[i]
+		}
+	}
+	return nil
+}
+
+func (j *Journal) entryPath(e *JournalEntry) string {
+	return filepath.Join(j.path, e.Id+MetadataFileExtension)
+}
+
+func (j *Journal) save(e *JournalEntry) error {
+	data, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(j.path, j.entryPath(e), data)
+	if err != nil {
+		return fmt.Errorf("failed to write journal for %v of volume '%v': %v", e.Operation, e.Volume, err)
+	}
+	return nil
+}
+
+type entriesByStart []*JournalEntry
+
+func (s entriesByStart) Len() int           { return len(s) }
+func (s entriesByStart) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s entriesByStart) Less(i, j int) bool { return s[i].StartedAt.Before(s[j].StartedAt) }
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+// volumeLocks serializes the operations on a single volume while letting
+// operations on different volumes run in parallel. The lock of a volume is
+// dropped once no operation holds it or waits for it, so the locks of
+// removed volumes do not pile up.
+type volumeLocks struct {
+	m     sync.Mutex
+	locks map[string]*volumeLock
+}
+
+type volumeLock struct {
+	sync.Mutex
+	users int
+}
+
+func newVolumeLocks() *volumeLocks {
+	return &volumeLocks{locks: make(map[string]*volumeLock)}
+}
+
+// lock locks the named volume and returns the function that unlocks it.
+func (l *volumeLocks) lock(name string) func() {
+	l.m.Lock()
+	lock, ok := l.locks[name]
+	if !ok {
+		lock = &volumeLock{}
+		l.locks[name] = lock
+	}
+	lock.users++
+	l.m.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+
+		l.m.Lock()
+		lock.users--
+		if lock.users == 0 {
+			delete(l.locks, name)
+		}
+		l.m.Unlock()
+	}
+}
+
+// unlocked releases the lock of the named volume, which the caller holds,
+// while fn runs.
+func (l *volumeLocks) unlocked(name string, fn func()) {
+	l.m.Lock()
+	lock := l.locks[name]
+	l.m.Unlock()
+
+	lock.Unlock()
+	defer lock.Lock()
+	fn()
+}
+
+// waitUnlocked marks the volume as busy with the operation and releases its
+// lock while fn waits for the cloud, so that inspecting or mounting the
+// volume does not block for minutes. Operations that conflict with it fail
+// while the volume is busy. The caller holds the lock of the volume; fn
+// must not touch its record.
+func (d *Driver) waitUnlocked(state *VolumeState, operation string, fn func() error) error {
+	state.Operation = operation
+	defer func() { state.Operation = "" }()
+
+	var err error
+	d.locks.unlocked(state.Name, func() {
+		err = fn()
+	})
+	return err
+}
+
+// lookupVolume returns the registered record of the named volume.
+func (d *Driver) lookupVolume(name string) (*VolumeState, bool) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	state, ok := d.volumes[name]
+	return state, ok
+}
+
+func (d *Driver) registerVolume(state *VolumeState) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	d.volumes[state.Name] = state
+}
+
+func (d *Driver) forgetVolume(name string) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	delete(d.volumes, name)
+}
+
+// volumeNames returns the names of all registered volumes in order.
+func (d *Driver) volumeNames() []string {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	names := make([]string, 0, len(d.volumes))
+	for name := range d.volumes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
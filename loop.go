@@ -0,0 +1,638 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	BackendProfitBricks = "profitbricks"
+	BackendLoop         = "loop"
+
+	DefaultLoopPath = "/var/lib/docker-volume-profitbricks-loop"
+
+	// LoopDatacenterId and LoopServerId stand in for the datacenter and the
+	// server with the loop backend, which only knows the local machine.
+	LoopDatacenterId = "loop"
+	LoopServerId     = "loop"
+
+	loopImageExt  = ".img"
+	loopRecordExt = ".json"
+)
+
+// LoopProvider implements BlockStorageProvider with sparse files on the
+// local disk, attached as loop devices with losetup. Volumes and snapshots
+// are kept in separate directories under the provider's path, each as an
+// image file and a JSON record. Every call completes before it returns, so
+// no request locations are handed out.
+//
+// Loop devices are gone after a reboot, so attached volumes are recorded
+// and attached again when the provider is created.
+type LoopProvider struct {
+	path string
+	run  CommandRunner
+	m    sync.Mutex
+}
+
+type loopRecord struct {
+	Id        string    `json:"id"`
+	Name      string    `json:"name"`
+	Size      int       `json:"size"`
+	Type      string    `json:"type,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	Attached  bool      `json:"attached,omitempty"`
+}
+
+func NewLoopProvider(path string, run CommandRunner) (*LoopProvider, error) {
+	p := &LoopProvider{path: path, run: run}
+	for _, dir := range []string{p.volumesPath(), p.snapshotsPath()} {
+		err := os.MkdirAll(dir, MetadataDirMode)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := p.restoreAttachments()
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// restoreAttachments sets up the loop devices of the attached volumes that
+// have none.
+func (p *LoopProvider) restoreAttachments() error {
+	records, err := p.listRecords(p.volumesPath())
+	if err != nil {
+		return err
+	}
+
+	for _, record := range records {
+		if !record.Attached {
+			continue
+		}
+		err = p.attach(record)
+		if err != nil {
+			return fmt.Errorf("failed to attach volume '%v' again: %v", record.Id, err)
+		}
+	}
+	return nil
+}
+
+// CreateVolume creates a sparse file of the volume's size. The Image of
+// the spec may name a snapshot to copy; images are not supported.
+func (p *LoopProvider) CreateVolume(datacenterId string, spec CloudVolume) (CloudVolume, string, error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	id, err := newLoopId()
+	if err != nil {
+		return CloudVolume{}, "", err
+	}
+
+	record := &loopRecord{
+		Id:        id,
+		Name:      spec.Name,
+		Size:      spec.Size,
+		Type:      spec.Type,
+		CreatedAt: time.Now().UTC(),
+	}
+	image := filepath.Join(p.volumesPath(), record.Id+loopImageExt)
+
+	if spec.Image != "" {
+		snapshot, err := p.loadRecord(p.snapshotsPath(), spec.Image, "snapshot")
+		if err != nil {
+			return CloudVolume{}, "", err
+		}
+		err = p.copyImage(filepath.Join(p.snapshotsPath(), snapshot.Id+loopImageExt), image)
+		if err != nil {
+			return CloudVolume{}, "", err
+		}
+		if snapshot.Size > record.Size {
+			record.Size = snapshot.Size
+		}
+	}
+
+	err = resizeImage(image, record.Size)
+	if err == nil {
+		err = p.saveRecord(p.volumesPath(), record)
+	}
+	if err != nil {
+		os.Remove(image)
+		return CloudVolume{}, "", err
+	}
+	return record.volume(), "", nil
+}
+
+// UpdateVolume renames and grows the volume. An attached volume's device
+// picks up the new size once it is rescanned.
+func (p *LoopProvider) UpdateVolume(datacenterId string, volumeId string, changes CloudVolume) (string, error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	record, err := p.loadRecord(p.volumesPath(), volumeId, "volume")
+	if err != nil {
+		return "", err
+	}
+
+	if changes.Name != "" {
+		record.Name = changes.Name
+	}
+	if changes.Size != 0 {
+		if changes.Size < record.Size {
+			return "", &ProviderError{StatusCode: http.StatusUnprocessableEntity, Message: fmt.Sprintf("volume '%v' cannot be shrunk", volumeId)}
+		}
+		err = resizeImage(filepath.Join(p.volumesPath(), volumeId+loopImageExt), changes.Size)
+		if err != nil {
+			return "", err
+		}
+		record.Size = changes.Size
+	}
+	return "", p.saveRecord(p.volumesPath(), record)
+}
+
+func (p *LoopProvider) GetVolume(datacenterId string, volumeId string) (CloudVolume, error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	record, err := p.loadRecord(p.volumesPath(), volumeId, "volume")
+	if err != nil {
+		return CloudVolume{}, err
+	}
+	return record.volume(), nil
+}
+
+func (p *LoopProvider) ListVolumes(datacenterId string) ([]CloudVolume, error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	records, err := p.listRecords(p.volumesPath())
+	if err != nil {
+		return nil, err
+	}
+
+	result := []CloudVolume{}
+	for _, record := range records {
+		result = append(result, record.volume())
+	}
+	return result, nil
+}
+
+// DeleteVolume detaches the volume if needed and deletes its file.
+func (p *LoopProvider) DeleteVolume(datacenterId string, volumeId string) (string, error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	_, err := p.loadRecord(p.volumesPath(), volumeId, "volume")
+	if err != nil {
+		return "", err
+	}
+
+	device, err := p.device(volumeId)
+	if err != nil {
+		return "", err
+	}
+	if device != "" {
+		_, err = p.run("losetup", "--detach", device)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	err = os.Remove(filepath.Join(p.volumesPath(), volumeId+loopImageExt))
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	return "", p.removeRecord(p.volumesPath(), volumeId)
+}
+
+func (p *LoopProvider) AttachVolume(datacenterId string, serverId string, volumeId string) (string, error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	if serverId != LoopServerId {
+		return "", notFound("server", serverId)
+	}
+	record, err := p.loadRecord(p.volumesPath(), volumeId, "volume")
+	if err != nil {
+		return "", err
+	}
+
+	err = p.attach(record)
+	if err != nil {
+		return "", err
+	}
+	record.Attached = true
+	return "", p.saveRecord(p.volumesPath(), record)
+}
+
+func (p *LoopProvider) attach(record *loopRecord) error {
+	device, err := p.device(record.Id)
+	if err != nil || device != "" {
+		return err
+	}
+	_, err = p.run("losetup", "--find", "--show", filepath.Join(p.volumesPath(), record.Id+loopImageExt))
+	return err
+}
+
+func (p *LoopProvider) DetachVolume(datacenterId string, serverId string, volumeId string) (string, error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	device, err := p.device(volumeId)
+	if err != nil {
+		return "", err
+	}
+	if serverId != LoopServerId || device == "" {
+		return "", notFound("attached volume", volumeId)
+	}
+	_, err = p.run("losetup", "--detach", device)
+	if err != nil {
+		return "", err
+	}
+
+	record, err := p.loadRecord(p.volumesPath(), volumeId, "volume")
+	if err != nil {
+		return "", err
+	}
+	record.Attached = false
+	return "", p.saveRecord(p.volumesPath(), record)
+}
+
+func (p *LoopProvider) GetAttachedVolume(datacenterId string, serverId string, volumeId string) (CloudVolume, error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	record, err := p.loadRecord(p.volumesPath(), volumeId, "volume")
+	if err != nil {
+		return CloudVolume{}, err
+	}
+	device, err := p.device(volumeId)
+	if err != nil {
+		return CloudVolume{}, err
+	}
+	if serverId != LoopServerId || device == "" {
+		return CloudVolume{}, notFound("attached volume", volumeId)
+	}
+	return record.volume(), nil
+}
+
+func (p *LoopProvider) ListAttachedVolumes(datacenterId string, serverId string) ([]CloudVolume, error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	if serverId != LoopServerId {
+		return nil, notFound("server", serverId)
+	}
+	return p.attachedVolumes()
+}
+
+func (p *LoopProvider) ListServers(datacenterId string) ([]CloudServer, error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	attached, err := p.attachedVolumes()
+	if err != nil {
+		return nil, err
+	}
+
+	server := CloudServer{Id: LoopServerId}
+	for _, vol := range attached {
+		server.VolumeIds = append(server.VolumeIds, vol.Id)
+	}
+	return []CloudServer{server}, nil
+}
+
+// CreateSnapshot copies the volume's file. Attached volumes are copied as
+// they are, like a snapshot of a running server, after the data written to
+// mounted filesystems was flushed to the files.
+func (p *LoopProvider) CreateSnapshot(datacenterId string, volumeId string, name string) (CloudSnapshot, string, error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	vol, err := p.loadRecord(p.volumesPath(), volumeId, "volume")
+	if err != nil {
+		return CloudSnapshot{}, "", err
+	}
+
+	id, err := newLoopId()
+	if err != nil {
+		return CloudSnapshot{}, "", err
+	}
+
+	record := &loopRecord{
+		Id:        id,
+		Name:      name,
+		Size:      vol.Size,
+		CreatedAt: time.Now().UTC(),
+	}
+	image := filepath.Join(p.snapshotsPath(), record.Id+loopImageExt)
+
+	syscall.Sync()
+	err = p.copyImage(filepath.Join(p.volumesPath(), volumeId+loopImageExt), image)
+	if err == nil {
+		err = p.saveRecord(p.snapshotsPath(), record)
+	}
+	if err != nil {
+		os.Remove(image)
+		return CloudSnapshot{}, "", err
+	}
+	return record.snapshot(), "", nil
+}
+
+// RestoreSnapshot replaces the content of a detached volume with the
+// snapshot. The volume keeps its size if the snapshot is smaller.
+func (p *LoopProvider) RestoreSnapshot(datacenterId string, volumeId string, snapshotId string) (string, error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	vol, err := p.loadRecord(p.volumesPath(), volumeId, "volume")
+	if err != nil {
+		return "", err
+	}
+	snapshot, err := p.loadRecord(p.snapshotsPath(), snapshotId, "snapshot")
+	if err != nil {
+		return "", err
+	}
+
+	device, err := p.device(volumeId)
+	if err != nil {
+		return "", err
+	}
+	if device != "" {
+		return "", &ProviderError{StatusCode: http.StatusUnprocessableEntity, Message: fmt.Sprintf("volume '%v' is attached as '%v'", volumeId, device)}
+	}
+
+	image := filepath.Join(p.volumesPath(), volumeId+loopImageExt)
+	err = p.copyImage(filepath.Join(p.snapshotsPath(), snapshotId+loopImageExt), image)
+	if err != nil {
+		return "", err
+	}
+	if snapshot.Size > vol.Size {
+		vol.Size = snapshot.Size
+	}
+	err = resizeImage(image, vol.Size)
+	if err != nil {
+		return "", err
+	}
+	return "", p.saveRecord(p.volumesPath(), vol)
+}
+
+func (p *LoopProvider) ListSnapshots() ([]CloudSnapshot, error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	records, err := p.listRecords(p.snapshotsPath())
+	if err != nil {
+		return nil, err
+	}
+
+	result := []CloudSnapshot{}
+	for _, record := range records {
+		result = append(result, record.snapshot())
+	}
+	return result, nil
+}
+
+func (p *LoopProvider) DeleteSnapshot(snapshotId string) (string, error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	_, err := p.loadRecord(p.snapshotsPath(), snapshotId, "snapshot")
+	if err != nil {
+		return "", err
+	}
+
+	err = os.Remove(filepath.Join(p.snapshotsPath(), snapshotId+loopImageExt))
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	return "", p.removeRecord(p.snapshotsPath(), snapshotId)
+}
+
+func (p *LoopProvider) GetImage(imageId string) (CloudImage, error) {
+	return CloudImage{}, &ProviderError{StatusCode: http.StatusNotFound, Message: "images are not supported by the loop backend"}
+}
+
+// Wait returns right away, all calls are done when they return.
+func (p *LoopProvider) Wait(ctx context.Context, location string) error {
+	return nil
+}
+
+// Device returns the loop device the volume is attached as, or an empty
+// string if it is not attached.
+func (p *LoopProvider) Device(volumeId string) (string, error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	return p.device(volumeId)
+}
+
+func (p *LoopProvider) device(volumeId string) (string, error) {
+	devices, err := p.loopDevices()
+	if err != nil {
+		return "", err
+	}
+	return devices[filepath.Join(p.volumesPath(), volumeId+loopImageExt)], nil
+}
+
+// loopDevices returns the loop devices of the host by their backing file.
+func (p *LoopProvider) loopDevices() (map[string]string, error) {
+	output, err := p.run("losetup", "--list", "--noheadings", "--output", "NAME,BACK-FILE")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list loop devices: %v", err)
+	}
+
+	devices := make(map[string]string)
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		devices[strings.Join(fields[1:], " ")] = fields[0]
+	}
+	return devices, nil
+}
+
+func (p *LoopProvider) attachedVolumes() ([]CloudVolume, error) {
+	devices, err := p.loopDevices()
+	if err != nil {
+		return nil, err
+	}
+	records, err := p.listRecords(p.volumesPath())
+	if err != nil {
+		return nil, err
+	}
+
+	result := []CloudVolume{}
+	for _, record := range records {
+		if devices[filepath.Join(p.volumesPath(), record.Id+loopImageExt)] != "" {
+			result = append(result, record.volume())
+		}
+	}
+	return result, nil
+}
+
+// copyImage copies an image file, keeping holes in sparse files.
+func (p *LoopProvider) copyImage(from string, to string) error {
+	_, err := p.run("cp", "--sparse=always", from, to)
+	return err
+}
+
+func (p *LoopProvider) volumesPath() string {
+	return filepath.Join(p.path, "volumes")
+}
+
+func (p *LoopProvider) snapshotsPath() string {
+	return filepath.Join(p.path, "snapshots")
+}
+
+func (p *LoopProvider) loadRecord(dir string, id string, kind string) (*loopRecord, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, id+loopRecordExt))
+	if os.IsNotExist(err) || strings.ContainsRune(id, os.PathSeparator) {
+		return nil, notFound(kind, id)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	record := &loopRecord{}
+	err = json.Unmarshal(data, record)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %v record '%v': %v", kind, id, err)
+	}
+	return record, nil
+}
+
+func (p *LoopProvider) listRecords(dir string) ([]*loopRecord, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*"+loopRecordExt))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	records := []*loopRecord{}
+	for _, file := range files {
+		id := strings.TrimSuffix(filepath.Base(file), loopRecordExt)
+		record, err := p.loadRecord(dir, id, "record")
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+func (p *LoopProvider) saveRecord(dir string, record *loopRecord) error {
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, record.Id+loopRecordExt), data, MetadataFileMode)
+}
+
+func (p *LoopProvider) removeRecord(dir string, id string) error {
+	err := os.Remove(filepath.Join(dir, id+loopRecordExt))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (r *loopRecord) volume() CloudVolume {
+	return CloudVolume{Id: r.Id, Name: r.Name, Size: r.Size, Type: r.Type}
+}
+
+func (r *loopRecord) snapshot() CloudSnapshot {
+	return CloudSnapshot{Id: r.Id, Name: r.Name, Size: r.Size}
+}
+
+// resizeImage creates or grows a sparse file to the given size in GB.
+func resizeImage(path string, sizeGB int) error {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, MetadataFileMode)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return file.Truncate(int64(sizeGB) << 30)
+}
+
+func notFound(kind string, id string) error {
+	return &ProviderError{StatusCode: http.StatusNotFound, Message: fmt.Sprintf("%v '%v' does not exist", kind, id)}
+}
+
+// newLoopId returns a random UUID.
+func newLoopId() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate an ID: %v", err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// LoopHost is the host side of the loop backend. Loop devices have no
+// serial, so they are looked up by their backing file; everything else is
+// done by the embedded Utilities.
+type LoopHost struct {
+	*Utilities
+	provider *LoopProvider
+}
+
+func NewLoopHost(utilities *Utilities, provider *LoopProvider) *LoopHost {
+	return &LoopHost{Utilities: utilities, provider: provider}
+}
+
+func (h *LoopHost) GetServerId() (string, error) {
+	return LoopServerId, nil
+}
+
+func (h *LoopHost) ResolveDevice(volumeId string, deviceNumber int64, bus string, sizeGB int, timeout time.Duration) (string, error) {
+	device, err := h.provider.Device(volumeId)
+	if err != nil {
+		return "", err
+	}
+	if device == "" {
+		return "", fmt.Errorf("volume '%v' is not attached to a loop device", volumeId)
+	}
+	err = h.VerifyDevice(device, volumeId, sizeGB)
+	if err != nil {
+		return "", err
+	}
+	return device, nil
+}
+
+// RescanDevice tells the loop driver to pick up the new size of the
+// backing file.
+func (h *LoopHost) ResolveMountedDevice(volumeId string, deviceNumber int64, bus string, mountPoint string) (string, error) {
+	device, err := h.provider.Device(volumeId)
+	if err != nil {
+		return "", err
+	}
+	if device == "" {
+		return "", fmt.Errorf("volume '%v' is not attached to a loop device", volumeId)
+	}
+	return checkMountedDevice(device, volumeId, mountPoint)
+}
+
+func (h *LoopHost) RescanDevice(device string, sizeGB int, timeout time.Duration) error {
+	_, err := h.run("losetup", "--set-capacity", device)
+	if err != nil {
+		return fmt.Errorf("failed to rescan '%v': %v", device, err)
+	}
+	return h.Utilities.RescanDevice(device, sizeGB, timeout)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"github.com/docker/go-plugins-helpers/volume"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoopRoundTrip(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("loop devices can only be set up by root")
+	}
+	if _, err := exec.LookPath("losetup"); err != nil {
+		t.Skip("losetup is not installed")
+	}
+
+	loopPath := t.TempDir()
+	provider, err := NewLoopProvider(loopPath, RunCommand)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := startDriver(t, provider, NewLoopHost(NewUtilities(), provider), testArgs(t.TempDir(), t.TempDir(), LoopDatacenterId, "HDD", 0))
+
+	if res := d.Create(volume.Request{Name: "data", Options: map[string]string{"size": "1"}}); res.Err != "" {
+		t.Fatalf("Create failed: %v", res.Err)
+	}
+	if !d.waitForBackground(testWait) {
+		t.Fatalf("volume is still being provisioned after %v", testWait)
+	}
+	res := d.Get(volume.Request{Name: "data"})
+	if res.Err != "" {
+		t.Fatalf("Get failed: %v", res.Err)
+	}
+	checkReady(t, "data", res.Volume.Status)
+	volumeId := res.Volume.Status["volumeId"].(string)
+
+	mount := d.Mount(volume.MountRequest{Name: "data", ID: "c1"})
+	if mount.Err != "" {
+		t.Fatalf("Mount failed: %v", mount.Err)
+	}
+	file := filepath.Join(mount.Mountpoint, "file")
+	if err := ioutil.WriteFile(file, []byte("data"), 0600); err != nil {
+		t.Fatalf("failed to write to the mounted volume: %v", err)
+	}
+	if res := d.Unmount(volume.UnmountRequest{Name: "data", ID: "c1"}); res.Err != "" {
+		t.Fatalf("Unmount failed: %v", res.Err)
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("file is still visible after the unmount: %v", err)
+	}
+
+	if res := d.Remove(volume.Request{Name: "data"}); res.Err != "" {
+		t.Fatalf("Remove failed: %v", res.Err)
+	}
+	if device, err := provider.Device(volumeId); err != nil || device != "" {
+		t.Errorf("volume is still attached to loop device %q after the remove: %v", device, err)
+	}
+	if images, _ := filepath.Glob(filepath.Join(loopPath, "volumes", "*")); len(images) != 0 {
+		t.Errorf("volume files left after the remove: %v", images)
+	}
+}
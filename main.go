@@ -3,15 +3,24 @@ package main
 import (
 	"fmt"
 	log "github.com/Sirupsen/logrus"
+	"github.com/docker/go-connections/sockets"
 	"github.com/docker/go-plugins-helpers/volume"
 	flag "github.com/ogier/pflag"
+	"net"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"syscall"
+	"time"
 )
 
 type CommandLineArgs struct {
 	profitbricksUsername *string
 	profitbricksPassword *string
+	profitbricksEndpoint *string
+	requestTimeout       *time.Duration
+	backend              *string
+	loopPath             *string
 	metadataPath         *string
 	mountPath            *string
 	unixSocketGroup      *string
@@ -19,6 +28,15 @@ type CommandLineArgs struct {
 	datacenterId         *string
 	size                 *int
 	diskType             *string
+	adminSocket          *string
+	snapshotPolicies     *string
+	growThreshold        *int
+	growStep             *int
+	growInterval         *time.Duration
+	mountWait            *time.Duration
+	poolSize             *int
+	poolProfiles         *string
+	poolCleanup          *bool
 }
 
 const (
@@ -26,10 +44,24 @@ const (
 	DefaultBaseMountPath    = "/var/lib/docker-volume-profitbricks"
 	DefaultUnixSocketGroup  = "docker"
 	DriverVersion           = "1.0.0"
+	PluginSocketDir         = "/run/docker/plugins"
+
+	// ShutdownTimeout is how long the plugin waits for its background work
+	// when it is stopped.
+	ShutdownTimeout = 30 * time.Second
 )
 
 func main() {
 
+	if len(os.Args) > 1 && isAdminCommand(os.Args[1]) {
+		err := runAdminCommand(os.Args[1:])
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	args := parseCommandLineArgs()
 	fmt.Println(*args.profitbricksUsername)
 	fmt.Println(*args.profitbricksPassword)
@@ -39,21 +71,134 @@ func main() {
 	fmt.Println(*args.version)
 	mountUtil := NewUtilities()
 
-	driver, err := ProfitBricksDriver(mountUtil, *args)
+	policies, err := LoadSnapshotPolicies(*args.snapshotPolicies)
+	if err != nil {
+		log.Fatalf("failed to load the snapshot policies: %v", err)
+		os.Exit(1)
+	}
+
+	var provider BlockStorageProvider
+	var utilities HostUtilities
+	switch *args.backend {
+	case BackendLoop:
+		loop, err := NewLoopProvider(*args.loopPath, RunCommand)
+		if err != nil {
+			log.Fatalf("failed to set up the loop backend under '%v': %v", *args.loopPath, err)
+			os.Exit(1)
+		}
+		provider = loop
+		utilities = NewLoopHost(mountUtil, loop)
+	default:
+		installSDKTransport()
+		provider = NewProfitBricksProvider(*args.profitbricksUsername, *args.profitbricksPassword, *args.profitbricksEndpoint, *args.requestTimeout)
+		utilities = mountUtil
+	}
+
+	driver, err := ProfitBricksDriver(provider, utilities, *args)
 	if err != nil {
 		log.Fatalf("failed to create the driver: %v", err)
 		os.Exit(1)
 	}
 
-	handler := volume.NewHandler(driver)
+	go NewSnapshotScheduler(driver, policies).Run()
+	go NewAutogrowMonitor(driver, *args.growThreshold, *args.growStep, *args.growInterval).Run()
+
+	if driver.pool != nil {
+		go driver.pool.Run()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	stopping := make(chan struct{})
+
+	adminListener, err := ListenAdmin(*args.adminSocket)
+	if err != nil {
+		log.Errorf("failed to create the admin socket '%v': %v", *args.adminSocket, err)
+	} else {
+		go func() {
+			err := ServeAdmin(driver, adminListener)
+			select {
+			case <-stopping:
+			default:
+				log.Errorf("stopped serving the admin socket '%v': %v", *args.adminSocket, err)
+			}
+		}()
+	}
 
 	//Start listening in a unix socket
-	err = handler.ServeUnix(*args.unixSocketGroup, syscall.Getegid())
+	listener, err := listenPlugin(*args.unixSocketGroup, syscall.Getegid())
 	if err != nil {
 		log.Fatalf("failed to bind to the Unix socket: %v", err)
 		os.Exit(1)
 	}
 
+	served := make(chan error, 1)
+	go func() {
+		served <- volume.NewHandler(driver).Serve(listener)
+	}()
+
+	exitCode := 0
+	select {
+	case sig := <-signals:
+		log.Infof("received %v, shutting down", sig)
+	case err := <-served:
+		log.Errorf("stopped serving the Unix socket: %v", err)
+		exitCode = 1
+	}
+
+	close(stopping)
+	shutdown(driver, listener, adminListener)
+	os.Exit(exitCode)
+}
+
+// listenPlugin creates the plugin socket where the volume helpers would:
+// under PluginSocketDir unless address is an absolute path.
+func listenPlugin(address string, gid int) (net.Listener, error) {
+	err := os.MkdirAll(PluginSocketDir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	if !filepath.IsAbs(address) {
+		address = filepath.Join(PluginSocketDir, address+".sock")
+	}
+	return sockets.NewUnixSocket(address, gid)
+}
+
+// shutdown stops serving requests, which removes the sockets, and gives
+// the background work of the driver up to ShutdownTimeout to finish: the
+// pool is closed, which deletes its volumes with --pool-cleanup, and
+// volumes still being provisioned are waited for. Work that is cut off is
+// rolled back or finished from the journal at the next start; the waits
+// for the cloud that are still running are canceled.
+func shutdown(driver *Driver, listeners ...net.Listener) {
+	for _, l := range listeners {
+		if l != nil {
+			l.Close()
+		}
+	}
+
+	deadline := time.Now().Add(ShutdownTimeout)
+
+	if driver.pool != nil {
+		if driver.pool.cleanup {
+			log.Info("deleting the volumes of the pool before shutting down")
+		}
+		closed := make(chan struct{})
+		go func() {
+			driver.pool.Close()
+			close(closed)
+		}()
+		select {
+		case <-closed:
+		case <-time.After(time.Until(deadline)):
+			log.Warnf("the pool was not closed within %v", ShutdownTimeout)
+		}
+	}
+
+	if !driver.waitForBackground(time.Until(deadline)) {
+		log.Warnf("volumes still being provisioned after %v are finished from the journal at the next start", ShutdownTimeout)
+	}
+	driver.cancel()
 }
 
 func parseCommandLineArgs() *CommandLineArgs {
@@ -65,6 +210,13 @@ func parseCommandLineArgs() *CommandLineArgs {
 	args.profitbricksUsername = flag.StringP("profitbricks-username", "u", "", "ProfitBricks user name")
 	args.profitbricksPassword = flag.StringP("profitbricks-password", "p", "", "ProfitBricks user name")
 
+	args.profitbricksEndpoint = flag.String("profitbricks-endpoint", os.Getenv("PROFITBRICKS_API_URL"), "the ProfitBricks Cloud API URL, e.g. of a fake-profitbricks server for testing")
+	args.requestTimeout = flag.Duration("request-timeout", DefaultRequestTimeout, "how long to wait for a ProfitBricks request to finish, 0 waits forever")
+
+	//Storage backend
+	args.backend = flag.String("backend", BackendProfitBricks, "where volumes are created: profitbricks, or loop for sparse files on this machine")
+	args.loopPath = flag.String("loop-path", DefaultLoopPath, "the path under which the loop backend keeps volume and snapshot files")
+
 	//ProfitBricks VDC, server and location parameters
 	args.datacenterId = flag.StringP("profitbricks-datacenter", "d", os.Getenv("PROFITBRICKS_DATACENTER"), "ProfitBricks Virtual Data Center ID")
 	args.size = flag.IntP("profitbricks-volume-size", "s", 50, "ProfitBricks Volume size")
@@ -74,6 +226,20 @@ func parseCommandLineArgs() *CommandLineArgs {
 	args.metadataPath = flag.String("metad§ata-path", DefaultBaseMetadataPath, "the path under which to store volume metadata")
 	args.mountPath = flag.StringP("mount-path", "m", DefaultBaseMountPath, "the path under which to create the volume mount folders")
 	args.unixSocketGroup = flag.StringP("unix-socket-group", "g", DefaultUnixSocketGroup, "the group to assign to the Unix socket file")
+	args.adminSocket = flag.String("admin-socket", DefaultAdminSocket, "the Unix socket for snapshot and other admin commands")
+	args.snapshotPolicies = flag.String("snapshot-policies", "", "a JSON file with the snapshot schedule and retention per volume")
+	args.mountWait = flag.Duration("mount-wait", DefaultMountWait, "how long a mount waits for a volume that is still being provisioned")
+
+	//Autogrow parameters
+	args.growThreshold = flag.Int("grow-threshold", DefaultGrowThreshold, "the filesystem usage in percent at which volumes with a max_size are grown")
+	args.growStep = flag.Int("grow-step", DefaultGrowStep, "the number of GB volumes are grown by")
+	args.growInterval = flag.Duration("grow-interval", DefaultGrowInterval, "how often the filesystem usage of mounted volumes is checked")
+
+	//Warm pool parameters
+	args.poolSize = flag.Int("pool-size", 0, "the number of formatted volumes kept ready per pool profile, 0 disables the pool")
+	args.poolProfiles = flag.String("pool-profiles", "", "comma separated <size>:<type>[:<fs>] profiles of the pool, defaults to the default size and disk type")
+	args.poolCleanup = flag.Bool("pool-cleanup", false, "delete the volumes of the pool when the plugin is stopped")
+
 	args.version = flag.BoolP("version", "v", false, "outputs the driver version and exits")
 	flag.Parse()
 
@@ -82,6 +248,32 @@ func parseCommandLineArgs() *CommandLineArgs {
 		os.Exit(0)
 	}
 
+	if *args.growThreshold < 1 || *args.growThreshold > 99 {
+		fmt.Println(fmt.Errorf("%q must be between 1 and 99, got %d", "--grow-threshold", *args.growThreshold))
+		os.Exit(1)
+	}
+	if *args.growStep <= 0 {
+		fmt.Println(fmt.Errorf("%q must be a positive number of GB, got %d", "--grow-step", *args.growStep))
+		os.Exit(1)
+	}
+	if *args.growInterval <= 0 {
+		fmt.Println(fmt.Errorf("%q must be a positive duration, got %v", "--grow-interval", *args.growInterval))
+		os.Exit(1)
+	}
+
+	switch *args.backend {
+	case BackendProfitBricks:
+	case BackendLoop:
+		// the loop backend only knows this machine and needs no account
+		if *args.datacenterId == "" {
+			*args.datacenterId = LoopDatacenterId
+		}
+		return args
+	default:
+		fmt.Println(fmt.Errorf("Unknown backend %q, use %q or %q", *args.backend, BackendProfitBricks, BackendLoop))
+		os.Exit(1)
+	}
+
 	if os.Getenv("PROFITBRICKS_USERNAME") != "" {
 		*args.profitbricksUsername = os.Getenv("PROFITBRICKS_USERNAME")
 	}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	MetadataVersion       = 1
+	MetadataFileExtension = ".json"
+
+	VolumeStatusProvisioning = "provisioning"
+	VolumeStatusReady        = "ready"
+	VolumeStatusFailed       = "failed"
+	VolumeStatusMissing      = "missing"
+
+	// OperationRestore marks a volume that is being restored from a
+	// snapshot and cannot be mounted.
+	OperationRestore = "restore"
+
+	// MaxHistoryEvents is how many events are kept in the history of a
+	// volume, older ones are dropped.
+	MaxHistoryEvents = 100
+)
+
+// VolumeState is the record kept for every Docker volume managed by the
+// driver. It is persisted as JSON under the metadata path so that it
+// survives plugin restarts.
+type VolumeState struct {
+	Version      int              `json:"version"`
+	Name         string           `json:"name"`
+	VolumeId     string           `json:"volumeId"`
+	DatacenterId string           `json:"datacenterId"`
+	ServerId     string           `json:"serverId"`
+	MountPoint   string           `json:"mountPoint"`
+	DeviceName   string           `json:"deviceName"`
+	DeviceNumber int64            `json:"deviceNumber"`
+	Filesystem   string           `json:"filesystem"`
+	Source       string           `json:"source,omitempty"`
+	Status       string           `json:"status"`
+	ProvisionErr string           `json:"provisionError,omitempty"`
+	Mounts       []string         `json:"mounts,omitempty"`
+	Snapshots    []SnapshotRecord `json:"snapshots,omitempty"`
+	History      []HistoryEvent   `json:"history,omitempty"`
+	Options      VolumeOptions    `json:"options"`
+	CreatedAt    time.Time        `json:"createdAt"`
+	UpdatedAt    time.Time        `json:"updatedAt"`
+
+	LastScheduledSnapshot time.Time `json:"lastScheduledSnapshot,omitempty"`
+
+	// Operation is the long running operation the volume is busy with
+	// while its lock is released to wait for the cloud.
+	Operation string `json:"-"`
+}
+
+// HistoryEvent records an operation that changed the contents or the size
+// of a volume after it was created. A failure that repeats the previous
+// event is counted in that event instead of being recorded again.
+type HistoryEvent struct {
+	Time      time.Time `json:"time"`
+	Operation string    `json:"operation"`
+	Details   string    `json:"details"`
+	Err       string    `json:"error,omitempty"`
+	Repeated  int       `json:"repeated,omitempty"`
+}
+
+func (s *VolumeState) recordEvent(operation string, details string, err error) {
+	event := HistoryEvent{
+		Time:      time.Now().UTC(),
+		Operation: operation,
+		Details:   details,
+	}
+	if err != nil {
+		event.Err = err.Error()
+	}
+
+	if n := len(s.History); n > 0 && event.Err != "" {
+		last := &s.History[n-1]
+		if last.Operation == event.Operation && last.Details == event.Details && last.Err == event.Err {
+			last.Time = event.Time
+			last.Repeated++
+			return
+		}
+	}
+
+	s.History = append(s.History, event)
+	if len(s.History) > MaxHistoryEvents {
+		s.History = s.History[len(s.History)-MaxHistoryEvents:]
+	}
+}
+
+// status returns the details reported in the Status field of
+// `docker volume inspect`.
+func (s *VolumeState) status() map[string]interface{} {
+	status := map[string]interface{}{
+		"volumeId":     s.VolumeId,
+		"size":         s.Options.Size,
+		"diskType":     s.Options.DiskType,
+		"datacenterId": s.DatacenterId,
+		"serverId":     s.ServerId,
+		"device":       s.DeviceName,
+		"filesystem":   s.Filesystem,
+		"state":        s.Status,
+		"mounts":       s.Mounts,
+		"snapshots":    len(s.Snapshots),
+	}
+	if s.ProvisionErr != "" {
+		status["error"] = s.ProvisionErr
+	}
+	if s.Operation != "" {
+		status["operation"] = s.Operation
+	}
+	return status
+}
+
+// checkProvisioned returns an error unless the volume was provisioned.
+func (s *VolumeState) checkProvisioned() error {
+	switch s.Status {
+	case VolumeStatusProvisioning:
+		return fmt.Errorf("Volume %q is still being provisioned", s.Name)
+	case VolumeStatusFailed:
+		return fmt.Errorf("Volume %q failed to provision: %v", s.Name, s.ProvisionErr)
+	}
+	return nil
+}
+
+// checkIdle returns an error if the volume is busy with a long running
+// operation.
+func (s *VolumeState) checkIdle() error {
+	if s.Operation != "" {
+		return fmt.Errorf("Volume %q is busy with a %v", s.Name, s.Operation)
+	}
+	return nil
+}
+
+func (s *VolumeState) hasMount(id string) bool {
+	for _, m := range s.Mounts {
+		if m == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *VolumeState) removeMount(id string) {
+	mounts := []string{}
+	for _, m := range s.Mounts {
+		if m != id {
+			mounts = append(mounts, m)
+		}
+	}
+	s.Mounts = mounts
+}
+
+func (d *Driver) metadataFilePath(name string) string {
+	return filepath.Join(d.metadataPath, name+MetadataFileExtension)
+}
+
+// saveVolumeState writes the record of the volume atomically.
+func (d *Driver) saveVolumeState(state *VolumeState) error {
+	state.Version = MetadataVersion
+	state.UpdatedAt = time.Now().UTC()
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = writeFileAtomic(d.metadataPath, d.metadataFilePath(state.Name), data)
+	if err != nil {
+		return fmt.Errorf("failed to write metadata for volume '%v': %v", state.Name, err)
+	}
+	return nil
+}
+
+// writeFileAtomic writes the data to a temporary file in dir and renames it
+// into place, so a crash never leaves a truncated file behind.
+func writeFileAtomic(dir string, path string, data []byte) error {
+	tmpFile, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmpFile.Name()
+
+	_, err = tmpFile.Write(data)
+	if err == nil {
+		err = tmpFile.Chmod(MetadataFileMode)
+	}
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+	}
+	return err
+}
+
+func (d *Driver) removeVolumeState(name string) error {
+	err := os.Remove(d.metadataFilePath(name))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// loadVolumeStates reads every record found under the metadata path.
+// Records that cannot be parsed are logged and skipped.
+func loadVolumeStates(metadataPath string) (map[string]*VolumeState, error) {
+	volumes := make(map[string]*VolumeState)
+
+	files, err := ioutil.ReadDir(metadataPath)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		if file.IsDir() || strings.HasPrefix(file.Name(), ".") || !strings.HasSuffix(file.Name(), MetadataFileExtension) {
+			continue
+		}
+
+		path := filepath.Join(metadataPath, file.Name())
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.Errorf("failed to read metadata file '%v': %v", path, err)
+			continue
+		}
+
+		state := &VolumeState{}
+		err = json.Unmarshal(data, state)
+		if err != nil {
+			log.Errorf("failed to parse metadata file '%v': %v", path, err)
+			continue
+		}
+		if state.Version > MetadataVersion {
+			log.Errorf("metadata file '%v' has unsupported version %d", path, state.Version)
+			continue
+		}
+
+		volumes[state.Name] = state
+	}
+	return volumes, nil
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	OptionSize             = "size"
+	OptionType             = "type"
+	OptionAvailabilityZone = "availability_zone"
+	OptionBus              = "bus"
+	OptionLicence          = "licence"
+	OptionFilesystem       = "fs"
+	OptionMkfsOptions      = "mkfs_opts"
+	OptionMountOptions     = "mount_opts"
+	OptionForceFormat      = "force_format"
+	OptionFromSnapshot     = "from_snapshot"
+	OptionFromImage        = "from_image"
+	OptionSnapshotSchedule = "snapshot_schedule"
+	OptionSnapshotKeep     = "snapshot_keep"
+	OptionMaxSize          = "max_size"
+	OptionGrowThreshold    = "grow_threshold"
+	OptionGrowStep         = "grow_step"
+
+	DefaultFilesystem = "ext4"
+)
+
+var (
+	diskTypes         = []string{"HDD", "SSD"}
+	availabilityZones = []string{"AUTO", "ZONE_1", "ZONE_2", "ZONE_3"}
+	busTypes          = []string{"VIRTIO", "IDE"}
+	licenceTypes      = []string{"LINUX", "WINDOWS", "WINDOWS2016", "UNKNOWN", "OTHER"}
+	filesystems       = []string{"ext4", "xfs", "btrfs"}
+)
+
+// VolumeOptions holds the per-volume settings that can be passed with
+// `docker volume create -o key=value`.
+type VolumeOptions struct {
+	Size             int    `json:"size"`
+	DiskType         string `json:"type"`
+	AvailabilityZone string `json:"availabilityZone,omitempty"`
+	Bus              string `json:"bus,omitempty"`
+	LicenceType      string `json:"licenceType"`
+	Filesystem       string `json:"fs"`
+	MkfsOptions      string `json:"mkfsOptions,omitempty"`
+	MountOptions     string `json:"mountOptions,omitempty"`
+	ForceFormat      bool   `json:"forceFormat,omitempty"`
+	FromSnapshot     string `json:"fromSnapshot,omitempty"`
+	FromImage        string `json:"fromImage,omitempty"`
+	SnapshotSchedule string `json:"snapshotSchedule,omitempty"`
+	SnapshotKeep     int    `json:"snapshotKeep,omitempty"`
+	MaxSize          int    `json:"maxSize,omitempty"`
+	GrowThreshold    int    `json:"growThreshold,omitempty"`
+	GrowStep         int    `json:"growStep,omitempty"`
+}
+
+// ParseVolumeOptions validates the options of a create request and applies
+// them on top of the given defaults. Unknown options are rejected.
+func ParseVolumeOptions(opts map[string]string, defaults VolumeOptions) (VolumeOptions, error) {
+	result := defaults
+
+	keys := make([]string, 0, len(opts))
+	for key := range opts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value := strings.TrimSpace(opts[key])
+		var err error
+
+		switch strings.ToLower(key) {
+		case OptionSize:
+			result.Size, err = strconv.Atoi(value)
+			if err != nil || result.Size <= 0 {
+				return result, fmt.Errorf("invalid value %q for option %q, expected a positive number of GB", value, key)
+			}
+		case OptionType:
+			result.DiskType, err = oneOf(key, value, diskTypes)
+		case OptionAvailabilityZone:
+			result.AvailabilityZone, err = oneOf(key, value, availabilityZones)
+		case OptionBus:
+			result.Bus, err = oneOf(key, value, busTypes)
+		case OptionLicence:
+			result.LicenceType, err = oneOf(key, value, licenceTypes)
+		case OptionFilesystem:
+			result.Filesystem, err = oneOf(key, value, filesystems)
+		case OptionMkfsOptions:
+			result.MkfsOptions = value
+		case OptionMountOptions:
+			if strings.ContainsAny(value, " \t") {
+				return result, fmt.Errorf("invalid value %q for option %q, expected a comma separated list", value, key)
+			}
+			result.MountOptions = value
+		case OptionForceFormat:
+			result.ForceFormat, err = strconv.ParseBool(value)
+			if err != nil {
+				return result, fmt.Errorf("invalid value %q for option %q, expected true or false", value, key)
+			}
+		case OptionFromSnapshot:
+			result.FromSnapshot = value
+		case OptionFromImage:
+			result.FromImage = value
+		case OptionSnapshotSchedule:
+			_, err = parseSchedule(value)
+			result.SnapshotSchedule = value
+		case OptionSnapshotKeep:
+			result.SnapshotKeep, err = strconv.Atoi(value)
+			if err != nil || result.SnapshotKeep <= 0 {
+				return result, fmt.Errorf("invalid value %q for option %q, expected a positive number", value, key)
+			}
+		case OptionMaxSize:
+			result.MaxSize, err = strconv.Atoi(value)
+			if err != nil || result.MaxSize <= 0 {
+				return result, fmt.Errorf("invalid value %q for option %q, expected a positive number of GB", value, key)
+			}
+		case OptionGrowThreshold:
+			result.GrowThreshold, err = strconv.Atoi(value)
+			if err != nil || result.GrowThreshold <= 0 || result.GrowThreshold >= 100 {
+				return result, fmt.Errorf("invalid value %q for option %q, expected a percentage between 1 and 99", value, key)
+			}
+		case OptionGrowStep:
+			result.GrowStep, err = strconv.Atoi(value)
+			if err != nil || result.GrowStep <= 0 {
+				return result, fmt.Errorf("invalid value %q for option %q, expected a positive number of GB", value, key)
+			}
+		default:
+			return result, fmt.Errorf("unknown option %q", key)
+		}
+
+		if err != nil {
+			return result, err
+		}
+	}
+
+	if result.FromSnapshot != "" && result.FromImage != "" {
+		return result, fmt.Errorf("options %q and %q cannot be combined", OptionFromSnapshot, OptionFromImage)
+	}
+
+	if result.SnapshotKeep != 0 && result.SnapshotSchedule == "" {
+		return result, fmt.Errorf("option %q requires %q", OptionSnapshotKeep, OptionSnapshotSchedule)
+	}
+	if result.SnapshotSchedule != "" && result.SnapshotKeep == 0 {
+		result.SnapshotKeep = DefaultSnapshotKeep
+	}
+
+	if result.MaxSize == 0 && (result.GrowThreshold != 0 || result.GrowStep != 0) {
+		return result, fmt.Errorf("options %q and %q require %q", OptionGrowThreshold, OptionGrowStep, OptionMaxSize)
+	}
+	if result.MaxSize != 0 && result.MaxSize < result.Size {
+		return result, fmt.Errorf("option %q of %d GB is smaller than the size of %d GB", OptionMaxSize, result.MaxSize, result.Size)
+	}
+	return result, nil
+}
+
+func oneOf(key string, value string, allowed []string) (string, error) {
+	for _, a := range allowed {
+		if strings.EqualFold(value, a) {
+			return a, nil
+		}
+	}
+	return "", fmt.Errorf("invalid value %q for option %q, expected one of %s", value, key, strings.Join(allowed, ", "))
+}
+
+// cloudOptions are the options that describe the ProfitBricks volume itself
+// and can be read back from the API.
+var cloudOptions = map[string]bool{
+	OptionSize:             true,
+	OptionType:             true,
+	OptionAvailabilityZone: true,
+	OptionBus:              true,
+	OptionFilesystem:       true,
+}
+
+// Conflicts returns the options of a create request whose values differ
+// from the ones an existing volume was created with. A requested size that
+// is smaller than the volume, e.g. after it was grown, is no conflict.
+func (o VolumeOptions) Conflicts(requested map[string]string, parsed VolumeOptions) []string {
+	conflicts := []string{}
+
+	for key := range requested {
+		var same bool
+
+		switch strings.ToLower(key) {
+		case OptionSize:
+			same = parsed.Size <= o.Size
+		case OptionType:
+			same = parsed.DiskType == o.DiskType
+		case OptionAvailabilityZone:
+			same = parsed.AvailabilityZone == o.AvailabilityZone
+		case OptionBus:
+			same = parsed.Bus == o.Bus
+		case OptionLicence:
+			same = parsed.LicenceType == o.LicenceType
+		case OptionFilesystem:
+			same = parsed.Filesystem == o.Filesystem
+		case OptionMkfsOptions:
+			same = parsed.MkfsOptions == o.MkfsOptions
+		case OptionMountOptions:
+			same = parsed.MountOptions == o.MountOptions
+		case OptionFromSnapshot:
+			same = parsed.FromSnapshot == o.FromSnapshot
+		case OptionFromImage:
+			same = parsed.FromImage == o.FromImage
+		case OptionSnapshotSchedule, OptionSnapshotKeep:
+			same = parsed.SnapshotSchedule == o.SnapshotSchedule && parsed.SnapshotKeep == o.SnapshotKeep
+		case OptionMaxSize, OptionGrowThreshold, OptionGrowStep:
+			same = parsed.MaxSize == o.MaxSize && parsed.GrowThreshold == o.GrowThreshold && parsed.GrowStep == o.GrowStep
+		default:
+			same = true
+		}
+
+		if !same {
+			conflicts = append(conflicts, key)
+		}
+	}
+
+	sort.Strings(conflicts)
+	return conflicts
+}
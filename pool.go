@@ -0,0 +1,504 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// PoolVolumePrefix names the cloud volumes of the warm pool. It differs
+	// from VolumeNamePrefix so pool volumes are never adopted as Docker
+	// volumes.
+	PoolVolumePrefix   = "docker-volume-profitbricks-pool:"
+	PoolRefillInterval = time.Minute
+
+	// MaxAttachedVolumes is the number of volumes ProfitBricks attaches to
+	// a single server at most.
+	MaxAttachedVolumes = 24
+)
+
+// PoolProfile is the size, disk type and filesystem of pool volumes.
+type PoolProfile struct {
+	Size       int
+	DiskType   string
+	Filesystem string
+}
+
+func (p PoolProfile) String() string {
+	return fmt.Sprintf("%d:%s:%s", p.Size, p.DiskType, p.Filesystem)
+}
+
+// ParsePoolProfiles parses a comma separated list of <size>:<type>[:<fs>]
+// profiles.
+func ParsePoolProfiles(profiles string) ([]PoolProfile, error) {
+	parsed := []PoolProfile{}
+	for _, profile := range strings.Split(profiles, ",") {
+		profile = strings.TrimSpace(profile)
+		if profile == "" {
+			continue
+		}
+
+		fields := strings.Split(profile, ":")
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("invalid pool profile %q, expected <size>:<type>[:<fs>]", profile)
+		}
+
+		opts := map[string]string{OptionSize: fields[0], OptionType: fields[1]}
+		if len(fields) == 3 {
+			opts[OptionFilesystem] = fields[2]
+		}
+		parsedOpts, err := ParseVolumeOptions(opts, VolumeOptions{Filesystem: DefaultFilesystem})
+		if err != nil {
+			return nil, fmt.Errorf("invalid pool profile %q: %v", profile, err)
+		}
+
+		parsed = append(parsed, PoolProfile{
+			Size:       parsedOpts.Size,
+			DiskType:   parsedOpts.DiskType,
+			Filesystem: parsedOpts.Filesystem,
+		})
+	}
+	return parsed, nil
+}
+
+// poolProfileFor returns the profile of the pool volumes that can be handed
+// out for a create with the given options. Volumes with options that are
+// set when the volume is created or formatted never come from the pool.
+func poolProfileFor(opts VolumeOptions) (PoolProfile, bool) {
+	if opts.FromSnapshot != "" || opts.FromImage != "" || opts.MkfsOptions != "" {
+		return PoolProfile{}, false
+	}
+	if opts.AvailabilityZone != "" && !strings.EqualFold(opts.AvailabilityZone, "AUTO") {
+		return PoolProfile{}, false
+	}
+	if opts.Bus != "" && !strings.EqualFold(opts.Bus, "VIRTIO") {
+		return PoolProfile{}, false
+	}
+	if !strings.EqualFold(opts.LicenceType, "OTHER") {
+		return PoolProfile{}, false
+	}
+	return PoolProfile{Size: opts.Size, DiskType: opts.DiskType, Filesystem: opts.Filesystem}, true
+}
+
+// VolumePool keeps a number of formatted volumes per profile attached to
+// the server, so that a create can hand one out right away instead of
+// waiting for ProfitBricks to provision it.
+type VolumePool struct {
+	driver   *Driver
+	size     int
+	profiles []PoolProfile
+	cleanup  bool
+	refill   chan struct{}
+	stop     chan struct{}
+	stopped  chan struct{}
+
+	// ctx is canceled by Close to abandon the requests of a refill
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	m       sync.Mutex
+	members map[PoolProfile][]*poolVolume
+}
+
+type poolVolume struct {
+	volumeId     string
+	deviceName   string
+	deviceNumber int64
+}
+
+func NewVolumePool(driver *Driver, size int, profiles []PoolProfile, cleanup bool) *VolumePool {
+	ctx, cancel := context.WithCancel(driver.ctx)
+	return &VolumePool{
+		driver:   driver,
+		size:     size,
+		profiles: profiles,
+		cleanup:  cleanup,
+		refill:   make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+		members:  make(map[PoolProfile][]*poolVolume),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+// Run picks up the pool volumes left attached by an earlier run and keeps
+// the pool filled until Close is called.
+func (p *VolumePool) Run() {
+	defer close(p.stopped)
+
+	err := p.discover()
+	if err != nil {
+		log.Errorf("failed to look up the volumes of the pool: %v", err)
+	}
+
+	for {
+		p.fill()
+
+		select {
+		case <-p.refill:
+		case <-time.After(PoolRefillInterval):
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// Close stops refilling the pool and, if the pool is configured to clean
+// up, deletes the volumes that were not handed out.
+func (p *VolumePool) Close() {
+	close(p.stop)
+	p.cancel()
+	<-p.stopped
+
+	if !p.cleanup {
+		return
+	}
+
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	d := p.driver
+	for profile, members := range p.members {
+		for _, member := range members {
+			err := d.detachVolume(d.datacenterId, d.serverId, member.volumeId)
+			if err == nil {
+				err = d.deleteVolume(d.datacenterId, member.volumeId)
+			}
+			if err != nil {
+				log.Errorf("failed to delete pool volume '%v': %v", member.volumeId, err)
+				continue
+			}
+			log.Infof("deleted %v pool volume '%v'", profile, member.volumeId)
+		}
+		delete(p.members, profile)
+	}
+}
+
+// take removes a volume of the profile from the pool.
+func (p *VolumePool) take(profile PoolProfile) *poolVolume {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	members := p.members[profile]
+	if len(members) == 0 {
+		return nil
+	}
+	member := members[0]
+	p.members[profile] = members[1:]
+	return member
+}
+
+func (p *VolumePool) put(profile PoolProfile, member *poolVolume) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	p.members[profile] = append(p.members[profile], member)
+}
+
+func (p *VolumePool) count(profile PoolProfile) int {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	return len(p.members[profile])
+}
+
+// wake asks for the pool to be refilled without waiting for the next
+// refill interval.
+func (p *VolumePool) wake() {
+	select {
+	case p.refill <- struct{}{}:
+	default:
+	}
+}
+
+// discover adds the formatted pool volumes attached to the server to the
+// pool. Pool volumes whose provisioning was interrupted are deleted.
+func (p *VolumePool) discover() error {
+	d := p.driver
+	attached, err := d.provider.ListAttachedVolumes(d.datacenterId, d.serverId)
+	if err != nil {
+		return fmt.Errorf("failed to list volumes attached to server '%v': %v", d.serverId, err)
+	}
+
+	for _, vol := range attached {
+		if !strings.HasPrefix(vol.Name, PoolVolumePrefix) {
+			continue
+		}
+
+		profile, ok := p.profileOf(vol.Name)
+		if ok {
+			member, err := p.inspect(vol, profile)
+			if err == nil {
+				p.put(profile, member)
+				log.Infof("found %v pool volume '%v'", profile, vol.Id)
+				continue
+			}
+			log.Warnf("pool volume '%v' is not usable: %v", vol.Id, err)
+		}
+
+		err := d.detachVolume(d.datacenterId, d.serverId, vol.Id)
+		if err == nil {
+			err = d.deleteVolume(d.datacenterId, vol.Id)
+		}
+		if err != nil {
+			log.Errorf("failed to delete pool volume '%v': %v", vol.Id, err)
+			continue
+		}
+		log.Infof("deleted pool volume '%v'", vol.Id)
+	}
+	return nil
+}
+
+// profileOf returns the configured profile a pool volume was created for.
+func (p *VolumePool) profileOf(cloudName string) (PoolProfile, bool) {
+	for _, profile := range p.profiles {
+		if cloudName == PoolVolumePrefix+profile.String() {
+			return profile, true
+		}
+	}
+	return PoolProfile{}, false
+}
+
+func (p *VolumePool) inspect(vol CloudVolume, profile PoolProfile) (*poolVolume, error) {
+	device, err := p.driver.utilities.ResolveDevice(vol.Id, vol.DeviceNumber, vol.Bus, vol.Size, DeviceWaitTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	filesystem, err := p.driver.utilities.GetFilesystem(device)
+	if err != nil {
+		return nil, err
+	}
+	if filesystem != profile.Filesystem {
+		return nil, fmt.Errorf("device '%v' has filesystem %q instead of %q", device, filesystem, profile.Filesystem)
+	}
+
+	return &poolVolume{volumeId: vol.Id, deviceName: device, deviceNumber: vol.DeviceNumber}, nil
+}
+
+// fill provisions pool volumes one at a time until every profile has the
+// configured number of them or the server has no free device left.
+func (p *VolumePool) fill() {
+	d := p.driver
+	for _, profile := range p.profiles {
+		for p.count(profile) < p.size {
+			select {
+			case <-p.stop:
+				return
+			default:
+			}
+
+			attached, err := d.provider.ListAttachedVolumes(d.datacenterId, d.serverId)
+			if err != nil {
+				log.Errorf("failed to list volumes attached to server '%v': %v", d.serverId, err)
+				return
+			}
+			if len(attached) >= MaxAttachedVolumes {
+				log.Warnf("server '%v' has %d volumes attached, not adding any to the pool", d.serverId, len(attached))
+				return
+			}
+
+			member, err := p.provision(profile)
+			if err != nil {
+				log.Errorf("failed to add a %v volume to the pool: %v", profile, err)
+				break
+			}
+			p.put(profile, member)
+			log.Infof("added %v volume '%v' to the pool", profile, member.volumeId)
+		}
+	}
+}
+
+// provision creates, attaches and formats a pool volume, and rolls the
+// completed steps back if one fails.
+func (p *VolumePool) provision(profile PoolProfile) (*poolVolume, error) {
+	d := p.driver
+	var undo rollback
+
+	vol, location, err := d.provider.CreateVolume(d.datacenterId, CloudVolume{
+		Size:        profile.Size,
+		Type:        profile.DiskType,
+		LicenceType: "OTHER",
+		Name:        PoolVolumePrefix + profile.String(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create volume: %v", err)
+	}
+
+	volumeId := vol.Id
+	undo.add(fmt.Sprintf("delete volume '%v'", volumeId), func() error {
+		return d.deleteVolume(d.datacenterId, volumeId)
+	})
+
+	err = d.provider.Wait(p.ctx, location)
+	if err != nil {
+		return nil, undo.run(err)
+	}
+
+	location, err = d.provider.AttachVolume(d.datacenterId, d.serverId, volumeId)
+	if err != nil {
+		return nil, undo.run(fmt.Errorf("failed to attach volume '%v': %v", volumeId, err))
+	}
+	undo.add(fmt.Sprintf("detach volume '%v'", volumeId), func() error {
+		return d.detachVolume(d.datacenterId, d.serverId, volumeId)
+	})
+
+	err = d.provider.Wait(p.ctx, location)
+	if err != nil {
+		return nil, undo.run(err)
+	}
+
+	vol, err = d.provider.GetAttachedVolume(d.datacenterId, d.serverId, volumeId)
+	if err != nil {
+		return nil, undo.run(fmt.Errorf("failed to get attached volume '%v': %v", volumeId, err))
+	}
+
+	device, err := d.utilities.ResolveDevice(volumeId, vol.DeviceNumber, vol.Bus, profile.Size, DeviceWaitTimeout)
+	if err != nil {
+		return nil, undo.run(err)
+	}
+
+	err = d.utilities.FormatVolume(device, profile.Filesystem, "", false)
+	if err != nil {
+		return nil, undo.run(err)
+	}
+
+	return &poolVolume{volumeId: volumeId, deviceName: device, deviceNumber: vol.DeviceNumber}, nil
+}
+
+// takePoolVolume takes a pool volume that matches the options out of the
+// pool. It returns nil if there is no pool or no matching volume.
+func (d *Driver) takePoolVolume(opts VolumeOptions) (PoolProfile, *poolVolume) {
+	if d.pool == nil {
+		return PoolProfile{}, nil
+	}
+
+	profile, ok := poolProfileFor(opts)
+	if !ok {
+		return PoolProfile{}, nil
+	}
+	return profile, d.pool.take(profile)
+}
+
+// provisionFromPool hands the pool volume over to the named Docker volume
+// in the background. If the pool volume cannot be claimed, the volume is
+// created like any other.
+func (d *Driver) provisionFromPool(name string, profile PoolProfile, member *poolVolume, opts VolumeOptions) {
+	defer d.pool.wake()
+
+	claimed, err := d.claimPoolVolume(name, profile, member, opts)
+	if !claimed {
+		log.Errorf("failed to claim pool volume '%v' for volume '%v': %v", member.volumeId, name, err)
+		d.pool.put(profile, member)
+
+		entry, err := d.journal.Begin(OperationCreate, name, d.datacenterId, d.serverId)
+		if err != nil {
+			log.Errorf("failed to create volume '%v': %v", name, err)
+			d.markProvisioningFailed(name, err)
+			d.provisioned(name)
+			return
+		}
+		entry.MountPoint = filepath.Join(d.mountPath, name)
+		d.provision(entry, opts, "", 0)
+		return
+	}
+
+	defer d.provisioned(name)
+	if err != nil {
+		log.Errorf("failed to create volume '%v': %v", name, err)
+		d.markProvisioningFailed(name, err)
+		return
+	}
+	log.Infof("volume '%v' claimed %v pool volume '%v'", name, profile, member.volumeId)
+}
+
+// claimPoolVolume hands the pool volume over to the named Docker volume by
+// renaming it. The claim is journaled like a create: once the rename was
+// requested the pool volume is used up, and a claim that fails or is
+// interrupted is rolled back by deleting the volume. It reports whether
+// the pool volume was used up; a claim refused before that leaves it
+// untouched.
+func (d *Driver) claimPoolVolume(name string, profile PoolProfile, member *poolVolume, opts VolumeOptions) (bool, error) {
+	entry, err := d.journal.Begin(OperationCreate, name, d.datacenterId, d.serverId)
+	if err != nil {
+		return false, err
+	}
+	entry.VolumeId = member.volumeId
+	entry.MountPoint = filepath.Join(d.mountPath, name)
+
+	var location string
+	err = d.journal.Step(entry, StepClaimVolume)
+	if err == nil {
+		location, err = d.provider.UpdateVolume(d.datacenterId, member.volumeId, CloudVolume{Name: VolumeNamePrefix + name})
+	}
+	if err != nil {
+		if finishErr := d.journal.Finish(entry); finishErr != nil {
+			log.Error(finishErr.Error())
+		}
+		return false, err
+	}
+
+	var undo rollback
+	undo.add(fmt.Sprintf("delete volume '%v'", member.volumeId), func() error {
+		return d.deleteVolume(d.datacenterId, member.volumeId)
+	})
+	undo.add(fmt.Sprintf("detach volume '%v'", member.volumeId), func() error {
+		return d.detachVolume(d.datacenterId, d.serverId, member.volumeId)
+	})
+
+	err = d.completeClaim(entry, &undo, location, profile, member, opts)
+	if err != nil {
+		err = undo.run(fmt.Errorf("failed to claim pool volume '%v': %v", member.volumeId, err))
+
+		// a failed rollback is retried when the journal is replayed
+		if undo.failed {
+			return true, err
+		}
+	}
+	if finishErr := d.journal.Finish(entry); finishErr != nil {
+		log.Error(finishErr.Error())
+	}
+	return true, err
+}
+
+func (d *Driver) completeClaim(entry *JournalEntry, undo *rollback, location string, profile PoolProfile, member *poolVolume, opts VolumeOptions) error {
+	err := d.waitForStep(entry, location)
+	if err != nil {
+		return err
+	}
+
+	mountPoint := entry.MountPoint
+	if _, err := os.Stat(mountPoint); os.IsNotExist(err) {
+		err = d.journal.Step(entry, StepMakeMountDir)
+		if err != nil {
+			return err
+		}
+
+		err = os.MkdirAll(mountPoint, MountDirMode)
+		if err != nil {
+			return err
+		}
+		undo.add(fmt.Sprintf("remove mount point '%v'", mountPoint), func() error {
+			return os.Remove(mountPoint)
+		})
+	}
+
+	return d.markReady(&VolumeState{
+		Name:         entry.Volume,
+		VolumeId:     member.volumeId,
+		DatacenterId: d.datacenterId,
+		ServerId:     d.serverId,
+		MountPoint:   mountPoint,
+		DeviceName:   member.deviceName,
+		DeviceNumber: member.deviceNumber,
+		Filesystem:   profile.Filesystem,
+		Options:      opts,
+	})
+}
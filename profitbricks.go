@@ -0,0 +1,488 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/profitbricks/profitbricks-sdk-go"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultRequestTimeout = 10 * time.Minute
+
+	// request status polls start fast, as small volumes are often ready
+	// within seconds, and back off up to the maximum interval
+	RequestPollInterval    = time.Second
+	RequestPollMaxInterval = 20 * time.Second
+)
+
+// APICallTimeout bounds a single call to the Cloud API. Calls are
+// serialized, so a hung call holds up all the others until it gives up.
+var APICallTimeout = time.Minute
+
+// sdkMutex serializes the calls into the ProfitBricks SDK, which keeps the
+// credentials and the endpoint in package variables.
+var sdkMutex sync.Mutex
+
+// sdkTransport carries the context of the SDK call in progress, see
+// installSDKTransport.
+var (
+	sdkTransport     = &callTransport{}
+	sdkTransportOnce sync.Once
+)
+
+// installSDKTransport makes SDK calls give up after APICallTimeout. The SDK
+// sends its requests with a new http.Client without a timeout and offers
+// no way to pass another one, so the process-wide http.DefaultTransport is
+// replaced with a wrapper. The wrapper only binds requests sent by the SDK,
+// recognized by its User-Agent, to the context of the call in progress;
+// all other requests are passed on unchanged. It is installed once, before
+// the first ProfitBricksProvider is used.
+func installSDKTransport() {
+	sdkTransportOnce.Do(func() {
+		sdkTransport.base = http.DefaultTransport
+		http.DefaultTransport = sdkTransport
+	})
+}
+
+type callTransport struct {
+	base http.RoundTripper
+
+	m   sync.Mutex
+	ctx context.Context
+}
+
+func (t *callTransport) setContext(ctx context.Context) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	t.ctx = ctx
+}
+
+func (t *callTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.m.Lock()
+	ctx := t.ctx
+	t.m.Unlock()
+
+	if ctx != nil && req.Header.Get("User-Agent") == profitbricks.AgentHeader {
+		req = req.WithContext(ctx)
+	}
+	return t.base.RoundTrip(req)
+}
+
+// DefaultProfitBricksEndpoint is the ProfitBricks Cloud API the SDK uses.
+var DefaultProfitBricksEndpoint = profitbricks.Endpoint
+
+// ProfitBricksProvider implements BlockStorageProvider with the ProfitBricks
+// Cloud API. Every provider carries its own credentials and endpoint, so
+// several accounts can be used side by side. Wait gives up on a request
+// after requestTimeout, if it is set. Calls only give up after
+// APICallTimeout once installSDKTransport was called.
+type ProfitBricksProvider struct {
+	username       string
+	password       string
+	endpoint       string
+	requestTimeout time.Duration
+}
+
+func NewProfitBricksProvider(username string, password string, endpoint string, requestTimeout time.Duration) *ProfitBricksProvider {
+	if endpoint == "" {
+		endpoint = DefaultProfitBricksEndpoint
+	}
+	return &ProfitBricksProvider{
+		username:       username,
+		password:       password,
+		endpoint:       strings.TrimSuffix(endpoint, "/"),
+		requestTimeout: requestTimeout,
+	}
+}
+
+// call runs fn against the SDK with the credentials and endpoint of the
+// provider, giving up after APICallTimeout.
+func (p *ProfitBricksProvider) call(fn func()) error {
+	return p.callContext(context.Background(), fn)
+}
+
+// callContext runs fn against the SDK like call and also gives up when ctx
+// is done. The SDK panics when a request cannot be sent or is cut off;
+// that is returned as an error.
+func (p *ProfitBricksProvider) callContext(ctx context.Context, fn func()) (err error) {
+	sdkMutex.Lock()
+	defer sdkMutex.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, APICallTimeout)
+	defer cancel()
+	sdkTransport.setContext(ctx)
+	defer sdkTransport.setContext(nil)
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("ProfitBricks API request failed: %v", r)
+		}
+	}()
+
+	profitbricks.SetAuth(p.username, p.password)
+	profitbricks.SetEndpoint(p.endpoint)
+	fn()
+	return nil
+}
+
+func (p *ProfitBricksProvider) CreateVolume(datacenterId string, spec CloudVolume) (CloudVolume, string, error) {
+	var vol profitbricks.Volume
+	err := p.call(func() {
+		vol = profitbricks.CreateVolume(datacenterId, profitbricks.Volume{Properties: volumeProperties(spec)})
+	})
+	if err == nil {
+		err = checkStatus(vol.StatusCode, vol.Response)
+	}
+	if err != nil {
+		return CloudVolume{}, "", err
+	}
+	return cloudVolume(vol), location(vol.Headers), nil
+}
+
+func (p *ProfitBricksProvider) UpdateVolume(datacenterId string, volumeId string, changes CloudVolume) (string, error) {
+	var vol profitbricks.Volume
+	err := p.call(func() {
+		vol = profitbricks.PatchVolume(datacenterId, volumeId, volumeProperties(changes))
+	})
+	if err == nil {
+		err = checkStatus(vol.StatusCode, vol.Response)
+	}
+	if err != nil {
+		return "", err
+	}
+	return location(vol.Headers), nil
+}
+
+func (p *ProfitBricksProvider) GetVolume(datacenterId string, volumeId string) (CloudVolume, error) {
+	var vol profitbricks.Volume
+	err := p.call(func() {
+		vol = profitbricks.GetVolume(datacenterId, volumeId)
+	})
+	if err == nil {
+		err = checkStatus(vol.StatusCode, vol.Response)
+	}
+	if err != nil {
+		return CloudVolume{}, err
+	}
+	return cloudVolume(vol), nil
+}
+
+func (p *ProfitBricksProvider) ListVolumes(datacenterId string) ([]CloudVolume, error) {
+	var vols profitbricks.Volumes
+	err := p.call(func() {
+		vols = profitbricks.ListVolumes(datacenterId)
+	})
+	if err == nil {
+		err = checkStatus(vols.StatusCode, vols.Response)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return cloudVolumes(vols), nil
+}
+
+func (p *ProfitBricksProvider) DeleteVolume(datacenterId string, volumeId string) (string, error) {
+	var resp profitbricks.Resp
+	err := p.call(func() {
+		resp = profitbricks.DeleteVolume(datacenterId, volumeId)
+	})
+	if err == nil {
+		err = checkStatus(resp.StatusCode, string(resp.Body))
+	}
+	if err != nil {
+		return "", err
+	}
+	return resp.Headers.Get("Location"), nil
+}
+
+func (p *ProfitBricksProvider) AttachVolume(datacenterId string, serverId string, volumeId string) (string, error) {
+	var vol profitbricks.Volume
+	err := p.call(func() {
+		vol = profitbricks.AttachVolume(datacenterId, serverId, volumeId)
+	})
+	if err == nil {
+		err = checkStatus(vol.StatusCode, vol.Response)
+	}
+	if err != nil {
+		return "", err
+	}
+	return location(vol.Headers), nil
+}
+
+func (p *ProfitBricksProvider) DetachVolume(datacenterId string, serverId string, volumeId string) (string, error) {
+	var resp profitbricks.Resp
+	err := p.call(func() {
+		resp = profitbricks.DetachVolume(datacenterId, serverId, volumeId)
+	})
+	if err == nil {
+		err = checkStatus(resp.StatusCode, string(resp.Body))
+	}
+	if err != nil {
+		return "", err
+	}
+	return resp.Headers.Get("Location"), nil
+}
+
+func (p *ProfitBricksProvider) GetAttachedVolume(datacenterId string, serverId string, volumeId string) (CloudVolume, error) {
+	var vol profitbricks.Volume
+	err := p.call(func() {
+		vol = profitbricks.GetAttachedVolume(datacenterId, serverId, volumeId)
+	})
+	if err == nil {
+		err = checkStatus(vol.StatusCode, vol.Response)
+	}
+	if err != nil {
+		return CloudVolume{}, err
+	}
+	return cloudVolume(vol), nil
+}
+
+func (p *ProfitBricksProvider) ListAttachedVolumes(datacenterId string, serverId string) ([]CloudVolume, error) {
+	var vols profitbricks.Volumes
+	err := p.call(func() {
+		vols = profitbricks.ListAttachedVolumes(datacenterId, serverId)
+	})
+	if err == nil {
+		err = checkStatus(vols.StatusCode, vols.Response)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return cloudVolumes(vols), nil
+}
+
+func (p *ProfitBricksProvider) ListServers(datacenterId string) ([]CloudServer, error) {
+	var servers profitbricks.Servers
+	err := p.call(func() {
+		servers = profitbricks.ListServers(datacenterId)
+	})
+	if err == nil {
+		err = checkStatus(servers.StatusCode, servers.Response)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result := []CloudServer{}
+	for _, server := range servers.Items {
+		s := CloudServer{Id: server.Id}
+		if server.Entities != nil && server.Entities.Volumes != nil {
+			for _, vol := range server.Entities.Volumes.Items {
+				s.VolumeIds = append(s.VolumeIds, vol.Id)
+			}
+		}
+		result = append(result, s)
+	}
+	return result, nil
+}
+
+func (p *ProfitBricksProvider) CreateSnapshot(datacenterId string, volumeId string, name string) (CloudSnapshot, string, error) {
+	var snapshot profitbricks.Snapshot
+	err := p.call(func() {
+		snapshot = profitbricks.CreateSnapshot(datacenterId, volumeId, url.QueryEscape(name))
+	})
+	if err == nil {
+		err = checkStatus(snapshot.StatusCode, snapshot.Response)
+	}
+	if err != nil {
+		return CloudSnapshot{}, "", err
+	}
+	return cloudSnapshot(snapshot), location(snapshot.Headers), nil
+}
+
+func (p *ProfitBricksProvider) RestoreSnapshot(datacenterId string, volumeId string, snapshotId string) (string, error) {
+	var resp profitbricks.Resp
+	err := p.call(func() {
+		resp = profitbricks.RestoreSnapshot(datacenterId, volumeId, snapshotId)
+	})
+	if err == nil {
+		err = checkStatus(resp.StatusCode, string(resp.Body))
+	}
+	if err != nil {
+		return "", err
+	}
+	return resp.Headers.Get("Location"), nil
+}
+
+func (p *ProfitBricksProvider) ListSnapshots() ([]CloudSnapshot, error) {
+	var snapshots profitbricks.Snapshots
+	err := p.call(func() {
+		snapshots = profitbricks.ListSnapshots()
+	})
+	if err == nil {
+		err = checkStatus(snapshots.StatusCode, snapshots.Response)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result := []CloudSnapshot{}
+	for _, snapshot := range snapshots.Items {
+		result = append(result, cloudSnapshot(snapshot))
+	}
+	return result, nil
+}
+
+func (p *ProfitBricksProvider) DeleteSnapshot(snapshotId string) (string, error) {
+	var resp profitbricks.Resp
+	err := p.call(func() {
+		resp = profitbricks.DeleteSnapshot(snapshotId)
+	})
+	if err == nil {
+		err = checkStatus(resp.StatusCode, string(resp.Body))
+	}
+	if err != nil {
+		return "", err
+	}
+	return resp.Headers.Get("Location"), nil
+}
+
+func (p *ProfitBricksProvider) GetImage(imageId string) (CloudImage, error) {
+	var image profitbricks.Image
+	err := p.call(func() {
+		image = profitbricks.GetImage(imageId)
+	})
+	if err == nil {
+		err = checkStatus(image.StatusCode, image.Response)
+	}
+	if err != nil {
+		return CloudImage{}, err
+	}
+	return CloudImage{Id: image.Id, Name: image.Properties.Name, Size: image.Properties.Size}, nil
+}
+
+// Wait polls the status of the request until it is done. The polls back
+// off exponentially with jitter. Polls that fail for transient reasons are
+// retried; Wait gives up when ctx is done or the request timeout passed.
+func (p *ProfitBricksProvider) Wait(ctx context.Context, location string) error {
+	if location == "" {
+		return fmt.Errorf("no request to wait for")
+	}
+	if p.requestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.requestTimeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	interval := RequestPollInterval
+	lastStatus := "unknown"
+	var lastErr error
+
+	for {
+		var request profitbricks.RequestStatus
+		err := p.callContext(ctx, func() {
+			request = profitbricks.GetRequestStatus(location)
+		})
+		if err == nil {
+			err = checkStatus(request.StatusCode, request.Response)
+		}
+		elapsed := time.Since(start).Round(time.Millisecond)
+
+		switch {
+		case err == nil:
+			lastStatus = request.Metadata.Status
+			lastErr = nil
+			log.Infof("request '%v' is %v after %v", location, lastStatus, elapsed)
+
+			if lastStatus == "DONE" {
+				return nil
+			}
+			if lastStatus == "FAILED" {
+				return fmt.Errorf("request '%v' failed after %v: %v", location, elapsed, request.Metadata.Message)
+			}
+		case isTransient(err):
+			lastErr = err
+			log.Warnf("failed to poll request '%v' after %v, retrying: %v", location, elapsed, err)
+		default:
+			return fmt.Errorf("failed to poll request '%v' after %v: %v", location, elapsed, err)
+		}
+
+		timer := time.NewTimer(jitter(interval))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			reason := "timed out"
+			if ctx.Err() == context.Canceled {
+				reason = "was canceled"
+			}
+			elapsed = time.Since(start).Round(time.Millisecond)
+			if lastErr != nil {
+				return fmt.Errorf("waiting for request '%v' %v after %v, last status %v, last poll failed: %v", location, reason, elapsed, lastStatus, lastErr)
+			}
+			return fmt.Errorf("waiting for request '%v' %v after %v, last status %v", location, reason, elapsed, lastStatus)
+		}
+
+		interval *= 2
+		if interval > RequestPollMaxInterval {
+			interval = RequestPollMaxInterval
+		}
+	}
+}
+
+// jitter spreads an interval over +-50%, so that waits started together do
+// not poll together.
+func jitter(interval time.Duration) time.Duration {
+	return interval/2 + time.Duration(rand.Int63n(int64(interval)))
+}
+
+func checkStatus(statusCode int, body string) error {
+	if statusCode > 299 {
+		return &ProviderError{StatusCode: statusCode, Message: body}
+	}
+	return nil
+}
+
+func location(headers *http.Header) string {
+	if headers == nil {
+		return ""
+	}
+	return headers.Get("Location")
+}
+
+func volumeProperties(vol CloudVolume) profitbricks.VolumeProperties {
+	return profitbricks.VolumeProperties{
+		Name:             vol.Name,
+		Size:             vol.Size,
+		Type:             vol.Type,
+		AvailabilityZone: vol.AvailabilityZone,
+		Bus:              vol.Bus,
+		LicenceType:      vol.LicenceType,
+		Image:            vol.Image,
+	}
+}
+
+func cloudVolume(vol profitbricks.Volume) CloudVolume {
+	return CloudVolume{
+		Id:               vol.Id,
+		Name:             vol.Properties.Name,
+		Size:             vol.Properties.Size,
+		Type:             vol.Properties.Type,
+		AvailabilityZone: vol.Properties.AvailabilityZone,
+		Bus:              vol.Properties.Bus,
+		LicenceType:      vol.Properties.LicenceType,
+		Image:            vol.Properties.Image,
+		DeviceNumber:     vol.Properties.DeviceNumber,
+	}
+}
+
+func cloudVolumes(vols profitbricks.Volumes) []CloudVolume {
+	result := []CloudVolume{}
+	for _, vol := range vols.Items {
+		result = append(result, cloudVolume(vol))
+	}
+	return result
+}
+
+func cloudSnapshot(snapshot profitbricks.Snapshot) CloudSnapshot {
+	return CloudSnapshot{Id: snapshot.Id, Name: snapshot.Properties.Name, Size: snapshot.Properties.Size}
+}
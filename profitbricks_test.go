@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"github.com/profitbricks/profitbricks-sdk-go"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWaitCancelsHungPoll(t *testing.T) {
+	hung := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(hung)
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	installSDKTransport()
+	provider := NewProfitBricksProvider("user", "password", srv.URL, 0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err := provider.Wait(ctx, srv.URL+"/requests/1/status")
+	if err == nil {
+		t.Fatal("Wait succeeded for a request whose poll hangs")
+	}
+	if !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("Wait failed with %q, want a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Wait returned after %v, want it to give up when ctx is done", elapsed)
+	}
+	<-hung
+}
+
+func TestHungCallHoldsUpWaitForAPICallTimeout(t *testing.T) {
+	apiCallTimeout := APICallTimeout
+	defer func() { APICallTimeout = apiCallTimeout }()
+	APICallTimeout = 500 * time.Millisecond
+
+	hung := make(chan struct{})
+	hungSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(hung)
+		<-r.Context().Done()
+	}))
+	defer hungSrv.Close()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"metadata": {"status": "DONE"}}`))
+	}))
+	defer srv.Close()
+
+	installSDKTransport()
+	hungProvider := NewProfitBricksProvider("user", "password", hungSrv.URL, 0)
+	provider := NewProfitBricksProvider("user", "password", srv.URL, 0)
+
+	failed := make(chan error, 1)
+	go func() {
+		_, err := hungProvider.GetVolume("datacenter", "volume")
+		failed <- err
+	}()
+	<-hung
+
+	start := time.Now()
+	err := provider.Wait(context.Background(), srv.URL+"/requests/1/status")
+	if err != nil {
+		t.Fatalf("Wait failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > APICallTimeout+time.Second {
+		t.Errorf("Wait returned after %v, want it held up by the hung call for at most %v", elapsed, APICallTimeout)
+	}
+	if err := <-failed; err == nil {
+		t.Error("hung call succeeded")
+	}
+}
+
+type recordingTransport struct {
+	requests []*http.Request
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.requests = append(t.requests, req)
+	return nil, context.Canceled
+}
+
+func TestCallTransportOnlyBindsSDKRequests(t *testing.T) {
+	base := &recordingTransport{}
+	transport := &callTransport{base: base}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	transport.setContext(ctx)
+
+	sdkReq, _ := http.NewRequest("GET", "http://api/requests", nil)
+	sdkReq.Header.Add("User-Agent", profitbricks.AgentHeader)
+	otherReq, _ := http.NewRequest("GET", "http://other/", nil)
+	transport.RoundTrip(sdkReq)
+	transport.RoundTrip(otherReq)
+
+	if base.requests[0].Context() != ctx {
+		t.Error("request of the SDK was not bound to the context of the call")
+	}
+	if base.requests[1].Context() == ctx {
+		t.Error("request that was not sent by the SDK was bound to the context of the call")
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"net/http"
+)
+
+// BlockStorageProvider is the cloud API the driver provisions volumes
+// with. Calls that start an asynchronous request return its location,
+// which is passed to Wait to block until the request is done or ctx is
+// canceled.
+type BlockStorageProvider interface {
+	CreateVolume(datacenterId string, spec CloudVolume) (CloudVolume, string, error)
+	UpdateVolume(datacenterId string, volumeId string, changes CloudVolume) (string, error)
+	GetVolume(datacenterId string, volumeId string) (CloudVolume, error)
+	ListVolumes(datacenterId string) ([]CloudVolume, error)
+	DeleteVolume(datacenterId string, volumeId string) (string, error)
+
+	AttachVolume(datacenterId string, serverId string, volumeId string) (string, error)
+	DetachVolume(datacenterId string, serverId string, volumeId string) (string, error)
+	GetAttachedVolume(datacenterId string, serverId string, volumeId string) (CloudVolume, error)
+	ListAttachedVolumes(datacenterId string, serverId string) ([]CloudVolume, error)
+	ListServers(datacenterId string) ([]CloudServer, error)
+
+	CreateSnapshot(datacenterId string, volumeId string, name string) (CloudSnapshot, string, error)
+	RestoreSnapshot(datacenterId string, volumeId string, snapshotId string) (string, error)
+	ListSnapshots() ([]CloudSnapshot, error)
+	DeleteSnapshot(snapshotId string) (string, error)
+	GetImage(imageId string) (CloudImage, error)
+
+	Wait(ctx context.Context, location string) error
+}
+
+// CloudVolume is a block storage volume. When it is used to create or
+// update a volume, empty fields are left to the provider.
+type CloudVolume struct {
+	Id               string
+	Name             string
+	Size             int
+	Type             string
+	AvailabilityZone string
+	Bus              string
+	LicenceType      string
+	Image            string
+	DeviceNumber     int64
+}
+
+type CloudSnapshot struct {
+	Id   string
+	Name string
+	Size int
+}
+
+type CloudImage struct {
+	Id   string
+	Name string
+	Size int
+}
+
+// CloudServer is a server and the IDs of the volumes attached to it.
+type CloudServer struct {
+	Id        string
+	VolumeIds []string
+}
+
+// ProviderError is returned for requests the cloud API rejected.
+type ProviderError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *ProviderError) Error() string {
+	return e.Message
+}
+
+// isNotFound reports whether the cloud API rejected a request because the
+// resource does not exist.
+func isNotFound(err error) bool {
+	providerErr, ok := err.(*ProviderError)
+	return ok && providerErr.StatusCode == http.StatusNotFound
+}
+
+// isTransient reports whether a failed call may succeed when it is
+// retried: the request did not reach the API, or the API was overloaded or
+// failed internally.
+func isTransient(err error) bool {
+	providerErr, ok := err.(*ProviderError)
+	if !ok {
+		return true
+	}
+	return providerErr.StatusCode == http.StatusTooManyRequests || providerErr.StatusCode >= 500
+}
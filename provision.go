@@ -0,0 +1,299 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const DefaultMountWait = 2 * time.Minute
+
+// provision does the cloud work of a create in the background. The record
+// of the volume is marked ready once the volume is attached, formatted and
+// saved, or failed after the completed steps are rolled back.
+func (d *Driver) provision(entry *JournalEntry, opts VolumeOptions, sourceId string, sourceSize int) {
+	name := entry.Volume
+	defer d.provisioned(name)
+
+	var undo rollback
+	err := d.provisionVolume(entry, &undo, opts, sourceId, sourceSize)
+	if err == nil {
+		log.Infof("volume '%v' is ready", name)
+		if err = d.journal.Finish(entry); err != nil {
+			log.Error(err.Error())
+		}
+		return
+	}
+
+	err = undo.run(err)
+	log.Errorf("failed to create volume '%v': %v", name, err)
+
+	// a failed rollback is retried when the journal is replayed
+	if !undo.failed {
+		if finishErr := d.journal.Finish(entry); finishErr != nil {
+			log.Error(finishErr.Error())
+		}
+	}
+	d.markProvisioningFailed(name, err)
+}
+
+func (d *Driver) provisionVolume(entry *JournalEntry, undo *rollback, opts VolumeOptions, sourceId string, sourceSize int) error {
+	name := entry.Volume
+
+	spec := CloudVolume{
+		Size:             opts.Size,
+		Type:             opts.DiskType,
+		AvailabilityZone: opts.AvailabilityZone,
+		Bus:              opts.Bus,
+		LicenceType:      opts.LicenceType,
+		Image:            sourceId,
+		Name:             VolumeNamePrefix + name,
+	}
+
+	err := d.journal.Step(entry, StepCreateVolume)
+	if err != nil {
+		return err
+	}
+
+	vol, location, err := d.provider.CreateVolume(entry.DatacenterId, spec)
+	if err != nil {
+		return fmt.Errorf("failed to create volume: %v", err)
+	}
+
+	volumeId := vol.Id
+	undo.add(fmt.Sprintf("delete volume '%v'", volumeId), func() error {
+		return d.deleteVolume(entry.DatacenterId, volumeId)
+	})
+
+	entry.VolumeId = volumeId
+	err = d.waitForStep(entry, location)
+	if err != nil {
+		return err
+	}
+
+	err = d.journal.Step(entry, StepAttachVolume)
+	if err != nil {
+		return err
+	}
+
+	location, err = d.provider.AttachVolume(entry.DatacenterId, entry.ServerId, volumeId)
+	if err != nil {
+		return fmt.Errorf("failed to attach volume '%v': %v", volumeId, err)
+	}
+	undo.add(fmt.Sprintf("detach volume '%v'", volumeId), func() error {
+		return d.detachVolume(entry.DatacenterId, entry.ServerId, volumeId)
+	})
+
+	err = d.waitForStep(entry, location)
+	if err != nil {
+		return err
+	}
+
+	vol, err = d.provider.GetAttachedVolume(entry.DatacenterId, entry.ServerId, volumeId)
+	if err != nil {
+		return fmt.Errorf("failed to get attached volume '%v': %v", volumeId, err)
+	}
+
+	deviceName, err := d.utilities.ResolveDevice(volumeId, vol.DeviceNumber, vol.Bus, opts.Size, DeviceWaitTimeout)
+	if err != nil {
+		return err
+	}
+
+	volumePath := entry.MountPoint
+
+	if _, err := os.Stat(volumePath); os.IsNotExist(err) {
+		err = d.journal.Step(entry, StepMakeMountDir)
+		if err != nil {
+			return err
+		}
+
+		err = os.MkdirAll(volumePath, MountDirMode)
+		if err != nil {
+			return err
+		}
+		undo.add(fmt.Sprintf("remove mount point '%v'", volumePath), func() error {
+			return os.Remove(volumePath)
+		})
+	}
+
+	err = d.journal.Step(entry, StepFormat)
+	if err != nil {
+		return err
+	}
+
+	err = d.initFilesystem(name, deviceName, volumePath, &opts, sourceId, sourceSize)
+	if err != nil {
+		return err
+	}
+
+	err = d.journal.Step(entry, StepSaveMetadata)
+	if err != nil {
+		return err
+	}
+
+	return d.markReady(&VolumeState{
+		Name:         name,
+		VolumeId:     volumeId,
+		DeviceName:   deviceName,
+		DeviceNumber: vol.DeviceNumber,
+		Filesystem:   opts.Filesystem,
+		Options:      opts,
+	})
+}
+
+// beginProvisioning saves and registers the record of a volume that is
+// about to be provisioned in the background. volumeId is set for a volume
+// that already exists in the cloud.
+func (d *Driver) beginProvisioning(name string, volumeId string, opts VolumeOptions, sourceId string) error {
+	state := &VolumeState{
+		Name:         name,
+		VolumeId:     volumeId,
+		DatacenterId: d.datacenterId,
+		ServerId:     d.serverId,
+		MountPoint:   filepath.Join(d.mountPath, name),
+		Filesystem:   opts.Filesystem,
+		Source:       sourceId,
+		Status:       VolumeStatusProvisioning,
+		Options:      opts,
+		CreatedAt:    time.Now().UTC(),
+	}
+
+	err := d.saveVolumeState(state)
+	if err != nil {
+		return err
+	}
+
+	d.registerVolume(state)
+	d.startProvisioning(name)
+	return nil
+}
+
+// markReady records the cloud volume and device a volume was provisioned
+// with in the background and marks it ready, once that is saved. Only
+// these fields of the registered record are changed.
+func (d *Driver) markReady(ready *VolumeState) error {
+	defer d.locks.lock(ready.Name)()
+
+	state, ok := d.lookupVolume(ready.Name)
+	if !ok {
+		return fmt.Errorf("record of volume '%v' disappeared while it was provisioned", ready.Name)
+	}
+
+	saved := *state
+	saved.setProvisioned(ready)
+	err := d.saveVolumeState(&saved)
+	if err != nil {
+		return err
+	}
+
+	state.setProvisioned(ready)
+	state.Version = saved.Version
+	state.UpdatedAt = saved.UpdatedAt
+	return nil
+}
+
+// setProvisioned takes the cloud volume, device and options found by
+// provisioning from ready and marks the record ready.
+func (s *VolumeState) setProvisioned(ready *VolumeState) {
+	s.VolumeId = ready.VolumeId
+	s.DeviceName = ready.DeviceName
+	s.DeviceNumber = ready.DeviceNumber
+	s.Filesystem = ready.Filesystem
+	s.Options = ready.Options
+	s.Status = VolumeStatusReady
+	s.ProvisionErr = ""
+}
+
+// markProvisioningFailed records why the volume could not be provisioned.
+// The record is kept so that Mount fails with the reason until the volume
+// is removed.
+func (d *Driver) markProvisioningFailed(name string, cause error) {
+	defer d.locks.lock(name)()
+
+	state, ok := d.lookupVolume(name)
+	if !ok || state.Status == VolumeStatusReady {
+		return
+	}
+
+	state.Status = VolumeStatusFailed
+	state.ProvisionErr = cause.Error()
+
+	err := d.saveVolumeState(state)
+	if err != nil {
+		log.Error(err.Error())
+	}
+}
+
+// startProvisioning registers a volume whose provisioning is about to start
+// in the background.
+func (d *Driver) startProvisioning(name string) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	d.provisioning[name] = make(chan struct{})
+}
+
+// provisioned wakes up the mounts waiting for the volume.
+func (d *Driver) provisioned(name string) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	if done, ok := d.provisioning[name]; ok {
+		close(done)
+		delete(d.provisioning, name)
+	}
+}
+
+// isProvisioning reports whether the volume is being provisioned, or its
+// interrupted create rolled back, in the background.
+func (d *Driver) isProvisioning(name string) bool {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	_, ok := d.provisioning[name]
+	return ok
+}
+
+// waitForProvisioning blocks until the background provisioning of the
+// volume ends or the mount wait expires. It returns right away for
+// volumes that are not being provisioned.
+func (d *Driver) waitForProvisioning(name string) error {
+	d.m.Lock()
+	done, ok := d.provisioning[name]
+	d.m.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	log.Infof("waiting up to %v for volume '%v' to be provisioned", d.mountWait, name)
+	select {
+	case <-done:
+		return nil
+	case <-time.After(d.mountWait):
+		return fmt.Errorf("Volume %q is still being provisioned after %v", name, d.mountWait)
+	}
+}
+
+// waitForBackground waits up to timeout for the volumes being provisioned
+// in the background and reports whether all of them are done.
+func (d *Driver) waitForBackground(timeout time.Duration) bool {
+	d.m.Lock()
+	pending := []chan struct{}{}
+	for _, done := range d.provisioning {
+		pending = append(pending, done)
+	}
+	d.m.Unlock()
+
+	expired := time.After(timeout)
+	for _, done := range pending {
+		select {
+		case <-done:
+		case <-expired:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// reconcile compares the local volume records with the volumes known to the
+// ProfitBricks API. Volumes carrying the driver's name prefix that are
+// attached to this server but have no local record are adopted, records
+// whose cloud volume no longer exists are marked as missing. Every
+// difference is logged.
+func (d *Driver) reconcile() error {
+	all, err := d.provider.ListVolumes(d.datacenterId)
+	if err != nil {
+		return fmt.Errorf("failed to list volumes of datacenter '%v': %v", d.datacenterId, err)
+	}
+
+	attached, err := d.provider.ListAttachedVolumes(d.datacenterId, d.serverId)
+	if err != nil {
+		return fmt.Errorf("failed to list volumes attached to server '%v': %v", d.serverId, err)
+	}
+
+	cloudVolumes := make(map[string]CloudVolume)
+	for _, vol := range all {
+		cloudVolumes[vol.Id] = vol
+	}
+
+	attachedVolumes := make(map[string]CloudVolume)
+	for _, vol := range attached {
+		attachedVolumes[vol.Id] = vol
+	}
+
+	known := make(map[string]bool)
+	for name, state := range d.volumes {
+		if state.VolumeId == "" {
+			// the create failed and was rolled back
+			continue
+		}
+		known[state.VolumeId] = true
+
+		if _, ok := cloudVolumes[state.VolumeId]; !ok {
+			if state.Status != VolumeStatusMissing {
+				log.Warnf("volume '%v': cloud volume '%v' no longer exists, marking it as missing", name, state.VolumeId)
+				d.setVolumeStatus(state, VolumeStatusMissing)
+			}
+			continue
+		}
+
+		if state.Status == VolumeStatusMissing {
+			log.Infof("volume '%v': cloud volume '%v' exists again", name, state.VolumeId)
+			d.setVolumeStatus(state, VolumeStatusReady)
+		}
+
+		if _, ok := attachedVolumes[state.VolumeId]; !ok {
+			log.Warnf("volume '%v': cloud volume '%v' is not attached to server '%v'", name, state.VolumeId, d.serverId)
+		}
+	}
+
+	for _, vol := range cloudVolumes {
+		if known[vol.Id] || !strings.HasPrefix(vol.Name, VolumeNamePrefix) {
+			continue
+		}
+
+		name := strings.TrimPrefix(vol.Name, VolumeNamePrefix)
+
+		if _, ok := attachedVolumes[vol.Id]; !ok {
+			log.Warnf("volume '%v': cloud volume '%v' has no local record and is not attached to this server, ignoring it", name, vol.Id)
+			continue
+		}
+
+		if state, ok := d.volumes[name]; ok {
+			log.Warnf("volume '%v': cloud volume '%v' is attached but the local record points to '%v', ignoring it", name, vol.Id, state.VolumeId)
+			continue
+		}
+
+		if d.isProvisioning(name) {
+			log.Infof("volume '%v': cloud volume '%v' belongs to an interrupted create that is rolled back, ignoring it", name, vol.Id)
+			continue
+		}
+
+		_, err := d.adoptVolume(name, attachedVolumes[vol.Id], 0)
+		if err != nil {
+			log.Errorf("volume '%v': failed to adopt cloud volume '%v': %v", name, vol.Id, err)
+			continue
+		}
+		log.Infof("volume '%v': adopted attached cloud volume '%v'", name, vol.Id)
+	}
+
+	return nil
+}
+
+// findExistingVolume looks for a cloud volume that carries the name of a
+// Docker volume without a local record, for example one created before the
+// plugin lost its metadata, and reports whether it is attached to this
+// server. Volumes attached to other servers belong to other Docker hosts
+// and are left alone. It returns nil if there is no volume to adopt.
+func (d *Driver) findExistingVolume(name string) (*CloudVolume, bool, error) {
+	all, err := d.provider.ListVolumes(d.datacenterId)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to list volumes of datacenter '%v': %v", d.datacenterId, err)
+	}
+
+	candidates := make(map[string]CloudVolume)
+	for _, vol := range all {
+		if vol.Name == VolumeNamePrefix+name {
+			candidates[vol.Id] = vol
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, false, nil
+	}
+
+	attached, err := d.provider.ListAttachedVolumes(d.datacenterId, d.serverId)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to list volumes attached to server '%v': %v", d.serverId, err)
+	}
+	for _, vol := range attached {
+		if _, ok := candidates[vol.Id]; ok {
+			return &vol, true, nil
+		}
+	}
+
+	servers, err := d.provider.ListServers(d.datacenterId)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to list servers of datacenter '%v': %v", d.datacenterId, err)
+	}
+	for _, server := range servers {
+		for _, volumeId := range server.VolumeIds {
+			delete(candidates, volumeId)
+		}
+	}
+
+	if len(candidates) > 1 {
+		return nil, false, fmt.Errorf("found %d unattached cloud volumes named '%v%v', remove the duplicates manually", len(candidates), VolumeNamePrefix, name)
+	}
+	for _, vol := range candidates {
+		return &vol, false, nil
+	}
+	return nil, false, nil
+}
+
+// adopt adopts the cloud volume found for a create request in the
+// background, attaching it first unless it is attached already. The record
+// of the volume is marked ready, or failed after a volume that was
+// attached for it is detached again. The cloud volume itself is never
+// deleted.
+func (d *Driver) adopt(name string, vol CloudVolume, attached bool, requested map[string]string, opts VolumeOptions) {
+	defer d.provisioned(name)
+
+	var undo rollback
+	err := d.adoptFound(&undo, name, vol, attached, requested, opts)
+	if err != nil {
+		err = undo.run(err)
+		log.Errorf("failed to adopt cloud volume '%v' for volume '%v': %v", vol.Id, name, err)
+		d.markProvisioningFailed(name, err)
+		return
+	}
+	log.Infof("volume '%v': adopted cloud volume '%v'", name, vol.Id)
+}
+
+func (d *Driver) adoptFound(undo *rollback, name string, vol CloudVolume, attached bool, requested map[string]string, opts VolumeOptions) error {
+	if !attached {
+		log.Infof("volume '%v': attaching unattached cloud volume '%v'", name, vol.Id)
+
+		location, err := d.provider.AttachVolume(d.datacenterId, d.serverId, vol.Id)
+		if err != nil {
+			return fmt.Errorf("failed to attach volume '%v': %v", vol.Id, err)
+		}
+		volumeId := vol.Id
+		undo.add(fmt.Sprintf("detach volume '%v'", volumeId), func() error {
+			return d.detachVolume(d.datacenterId, d.serverId, volumeId)
+		})
+
+		err = d.provider.Wait(d.ctx, location)
+		if err != nil {
+			return err
+		}
+
+		vol, err = d.provider.GetAttachedVolume(d.datacenterId, d.serverId, volumeId)
+		if err != nil {
+			return fmt.Errorf("failed to get attached volume '%v': %v", volumeId, err)
+		}
+	}
+
+	state, err := d.inspectVolume(name, vol, requested, opts, DeviceWaitTimeout)
+	if err != nil {
+		return err
+	}
+	return d.markReady(state)
+}
+
+// adoptVolume creates the local record for a cloud volume that is attached
+// to this server and already carries a filesystem.
+func (d *Driver) adoptVolume(name string, vol CloudVolume, timeout time.Duration) (*VolumeState, error) {
+	state, err := d.inspectVolume(name, vol, nil, VolumeOptions{}, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	err = d.saveVolumeState(state)
+	if err != nil {
+		return nil, err
+	}
+	d.registerVolume(state)
+	return state, nil
+}
+
+// inspectVolume returns the record of a cloud volume that is attached to
+// this server and already carries a filesystem. The volume is checked
+// against the options of a create request, if any.
+func (d *Driver) inspectVolume(name string, vol CloudVolume, requested map[string]string, opts VolumeOptions, timeout time.Duration) (*VolumeState, error) {
+	device, err := d.utilities.ResolveDevice(vol.Id, vol.DeviceNumber, vol.Bus, vol.Size, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	filesystem, err := d.utilities.GetFilesystem(device)
+	if err != nil {
+		return nil, err
+	}
+	if filesystem == "" {
+		return nil, fmt.Errorf("device '%v' has no filesystem", device)
+	}
+
+	options, err := adoptedOptions(vol, filesystem, requested, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	mountPoint := filepath.Join(d.mountPath, name)
+
+	err = os.MkdirAll(mountPoint, MountDirMode)
+	if err != nil {
+		return nil, err
+	}
+
+	return &VolumeState{
+		Name:         name,
+		VolumeId:     vol.Id,
+		DatacenterId: d.datacenterId,
+		ServerId:     d.serverId,
+		MountPoint:   mountPoint,
+		DeviceName:   device,
+		DeviceNumber: vol.DeviceNumber,
+		Filesystem:   filesystem,
+		Status:       VolumeStatusReady,
+		Options:      options,
+		CreatedAt:    time.Now().UTC(),
+	}, nil
+}
+
+func (d *Driver) setVolumeStatus(state *VolumeState, status string) {
+	state.Status = status
+	err := d.saveVolumeState(state)
+	if err != nil {
+		log.Error(err.Error())
+	}
+}
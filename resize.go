@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+)
+
+// Resize grows the ProfitBricks volume behind the named Docker volume to
+// the given size in GB and grows its filesystem to match. Mounted volumes
+// are resized online. Shrinking is not supported.
+func (d *Driver) Resize(name string, size int) (*VolumeState, error) {
+	defer d.locks.lock(name)()
+
+	state, ok := d.lookupVolume(name)
+	if !ok {
+		return nil, fmt.Errorf("Volume %q does not exist", name)
+	}
+	if err := state.checkProvisioned(); err != nil {
+		return nil, err
+	}
+
+	err := d.resizeVolume(state, size, "resize")
+	if err != nil {
+		return nil, err
+	}
+	resized := *state
+	return &resized, nil
+}
+
+// resizeVolume resizes the volume, whose lock the caller holds. The lock
+// is released while the cloud resizes the volume.
+func (d *Driver) resizeVolume(state *VolumeState, size int, operation string) error {
+	if err := state.checkIdle(); err != nil {
+		return err
+	}
+
+	oldSize := state.Options.Size
+	if size < oldSize {
+		return fmt.Errorf("volume '%v' has %d GB and cannot be shrunk to %d GB", state.Name, oldSize, size)
+	}
+	if size == oldSize {
+		return nil
+	}
+
+	// the device is found again before anything is changed, as its name
+	// may have changed since it was recorded
+	device, err := d.resolveDevice(state)
+	if err != nil {
+		return err
+	}
+
+	datacenterId, volumeId := state.DatacenterId, state.VolumeId
+	err = d.waitUnlocked(state, operation, func() error {
+		location, err := d.provider.UpdateVolume(datacenterId, volumeId, CloudVolume{Size: size})
+		if err != nil {
+			return fmt.Errorf("failed to resize volume '%v': %v", volumeId, err)
+		}
+		return d.provider.Wait(d.ctx, location)
+	})
+	if err == nil {
+		state.Options.Size = size
+
+		err = d.utilities.RescanDevice(device, size, DeviceWaitTimeout)
+		if err == nil {
+			err = d.utilities.GrowFilesystem(device, state.MountPoint, state.Filesystem)
+		}
+	}
+
+	state.recordEvent(operation, fmt.Sprintf("grown from %d GB to %d GB", oldSize, size), err)
+	if saveErr := d.saveVolumeState(state); saveErr != nil {
+		log.Error(saveErr.Error())
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Infof("%v of volume '%v' from %d GB to %d GB done", operation, state.Name, oldSize, size)
+	return nil
+}
+
+// resolveDevice finds the device of the volume again, through the serial
+// checks of ResolveDevice or, while it is mounted, ResolveMountedDevice,
+// and records it. The device of a volume is looked up before it is
+// rescanned or its filesystem is grown, as device names are not stable
+// across attaching the volume again or rebooting.
+func (d *Driver) resolveDevice(state *VolumeState) (string, error) {
+	mounted, err := d.utilities.IsMounted(state.MountPoint)
+	if err != nil {
+		return "", err
+	}
+
+	var device string
+	if mounted {
+		device, err = d.utilities.ResolveMountedDevice(state.VolumeId, state.DeviceNumber, state.Options.Bus, state.MountPoint)
+	} else {
+		device, err = d.utilities.ResolveDevice(state.VolumeId, state.DeviceNumber, state.Options.Bus, state.Options.Size, DeviceWaitTimeout)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if device != state.DeviceName {
+		log.Infof("volume '%v' moved from device '%v' to '%v'", state.Name, state.DeviceName, device)
+		state.DeviceName = device
+	}
+	return device, nil
+}
+
+// refreshSize picks up the size of a volume that was grown by a resize
+// which completed after the driver stopped waiting for it, and grows its
+// filesystem to match. device must have just been resolved for the
+// volume, never taken from its record. A filesystem that cannot be grown
+// is only logged, the volume stays usable at its previous filesystem size.
+func (d *Driver) refreshSize(state *VolumeState, device string) {
+	size, err := d.utilities.DeviceSize(device)
+	if err != nil {
+		log.Errorf("failed to get the size of device '%v' of volume '%v': %v", device, state.Name, err)
+		return
+	}
+	oldSize := state.Options.Size
+	if size <= oldSize {
+		return
+	}
+
+	log.Warnf("volume '%v' was grown from %d GB to %d GB after the driver stopped waiting for it", state.Name, oldSize, size)
+	state.Options.Size = size
+
+	err = d.utilities.GrowFilesystem(device, state.MountPoint, state.Filesystem)
+	if err != nil {
+		log.Errorf("failed to grow the filesystem of volume '%v': %v", state.Name, err)
+	}
+	state.recordEvent("resize", fmt.Sprintf("grown from %d GB to %d GB", oldSize, size), err)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"strings"
+)
+
+// rollback collects a compensating action for every completed step of a
+// multi-step operation, so the steps can be undone if a later one fails.
+type rollback struct {
+	steps  []rollbackStep
+	failed bool
+}
+
+type rollbackStep struct {
+	description string
+	undo        func() error
+}
+
+func (r *rollback) add(description string, undo func() error) {
+	r.steps = append(r.steps, rollbackStep{description: description, undo: undo})
+}
+
+// run undoes the registered steps in reverse order and returns an error
+// describing both the original failure and the outcome of the rollback.
+func (r *rollback) run(cause error) error {
+	if len(r.steps) == 0 {
+		return cause
+	}
+
+	done := []string{}
+	failed := []string{}
+	for i := len(r.steps) - 1; i >= 0; i-- {
+		step := r.steps[i]
+		err := step.undo()
+		if err != nil {
+			log.Errorf("rollback: failed to %v: %v", step.description, err)
+			failed = append(failed, fmt.Sprintf("%v: %v", step.description, err))
+			r.failed = true
+			continue
+		}
+		log.Infof("rollback: %v", step.description)
+		done = append(done, step.description)
+	}
+	r.steps = nil
+
+	if len(failed) > 0 {
+		return fmt.Errorf("%v; rollback failed, manual cleanup needed: %v", cause, strings.Join(failed, "; "))
+	}
+	return fmt.Errorf("%v; rolled back: %v", cause, strings.Join(done, ", "))
+}
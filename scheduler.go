@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultSnapshotKeep = 7
+	SchedulerInterval   = time.Minute
+	MaxSnapshotBackoff  = time.Hour
+)
+
+var scheduleDescriptors = map[string]time.Duration{
+	"@hourly": time.Hour,
+	"@daily":  24 * time.Hour,
+	"@weekly": 7 * 24 * time.Hour,
+}
+
+// SnapshotPolicy defines how often a volume is snapshotted and how many of
+// the scheduled snapshots are kept.
+type SnapshotPolicy struct {
+	Schedule string `json:"schedule"`
+	Keep     int    `json:"keep"`
+}
+
+// SnapshotScheduler takes the scheduled snapshots of all volumes that have
+// a snapshot policy, either from their create options or from the policy
+// file, and deletes the ones that fall out of the retention window.
+type SnapshotScheduler struct {
+	driver   *Driver
+	policies map[string]SnapshotPolicy
+
+	// failures counts the scheduled snapshots of a volume that failed in a
+	// row and retryAt holds off the next attempt until then. Both are only
+	// used by Run.
+	failures map[string]int
+	retryAt  map[string]time.Time
+}
+
+// parseSchedule accepts @hourly, @daily, @weekly and @every <duration>.
+func parseSchedule(schedule string) (time.Duration, error) {
+	if interval, ok := scheduleDescriptors[schedule]; ok {
+		return interval, nil
+	}
+
+	if strings.HasPrefix(schedule, "@every ") {
+		interval, err := time.ParseDuration(strings.TrimPrefix(schedule, "@every "))
+		if err == nil && interval >= SchedulerInterval {
+			return interval, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid snapshot schedule %q, expected @hourly, @daily, @weekly or @every <duration> of at least %v", schedule, SchedulerInterval)
+}
+
+// LoadSnapshotPolicies reads a JSON file that maps volume names to their
+// snapshot policy.
+func LoadSnapshotPolicies(path string) (map[string]SnapshotPolicy, error) {
+	policies := make(map[string]SnapshotPolicy)
+	if path == "" {
+		return policies, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, &policies)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse snapshot policies '%v': %v", path, err)
+	}
+
+	for name, policy := range policies {
+		if _, err := parseSchedule(policy.Schedule); err != nil {
+			return nil, fmt.Errorf("volume '%v': %v", name, err)
+		}
+		if policy.Keep < 0 {
+			return nil, fmt.Errorf("volume '%v': keep must not be negative", name)
+		}
+		if policy.Keep == 0 {
+			policy.Keep = DefaultSnapshotKeep
+			policies[name] = policy
+		}
+	}
+	return policies, nil
+}
+
+func NewSnapshotScheduler(driver *Driver, policies map[string]SnapshotPolicy) *SnapshotScheduler {
+	return &SnapshotScheduler{
+		driver:   driver,
+		policies: policies,
+		failures: make(map[string]int),
+		retryAt:  make(map[string]time.Time),
+	}
+}
+
+// Run checks every SchedulerInterval which volumes are due. Runs that were
+// missed while the plugin was not running are caught up on the first check.
+func (s *SnapshotScheduler) Run() {
+	for {
+		s.runDue(time.Now().UTC())
+		time.Sleep(SchedulerInterval)
+	}
+}
+
+func (s *SnapshotScheduler) runDue(now time.Time) {
+	for name, policy := range s.duePolicies(now) {
+		_, err := s.driver.createSnapshot(name, "", true)
+		if err != nil {
+			s.backOff(name, now)
+			log.Errorf("scheduled snapshot of volume '%v' failed, retrying at %v: %v", name, s.retryAt[name].Format(time.RFC3339), err)
+		} else {
+			delete(s.failures, name)
+			delete(s.retryAt, name)
+		}
+
+		// snapshots that were created but not finished are pruned as well
+		err = s.driver.pruneSnapshots(name, policy.Keep)
+		if err != nil {
+			log.Errorf("failed to delete expired snapshots of volume '%v': %v", name, err)
+		}
+	}
+}
+
+// backOff delays the next scheduled snapshot of a volume after a failure,
+// starting at SchedulerInterval and doubling with every further failure up
+// to MaxSnapshotBackoff.
+func (s *SnapshotScheduler) backOff(name string, now time.Time) {
+	s.failures[name]++
+
+	backoff := SchedulerInterval
+	for i := 1; i < s.failures[name] && backoff < MaxSnapshotBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > MaxSnapshotBackoff {
+		backoff = MaxSnapshotBackoff
+	}
+	s.retryAt[name] = now.Add(backoff)
+}
+
+func (s *SnapshotScheduler) duePolicies(now time.Time) map[string]SnapshotPolicy {
+	due := make(map[string]SnapshotPolicy)
+	for _, name := range s.driver.volumeNames() {
+		if now.Before(s.retryAt[name]) {
+			continue
+		}
+		policy, ok := s.policy(name, now)
+		if ok {
+			due[name] = policy
+		}
+	}
+	return due
+}
+
+// policy returns the snapshot policy of the volume if a snapshot is due.
+func (s *SnapshotScheduler) policy(name string, now time.Time) (SnapshotPolicy, bool) {
+	d := s.driver
+	defer d.locks.lock(name)()
+
+	state, ok := d.lookupVolume(name)
+	if !ok {
+		return SnapshotPolicy{}, false
+	}
+
+	policy, ok := s.policies[name]
+	if !ok {
+		policy = SnapshotPolicy{Schedule: state.Options.SnapshotSchedule, Keep: state.Options.SnapshotKeep}
+	}
+	if policy.Schedule == "" || state.Status != VolumeStatusReady {
+		return policy, false
+	}
+
+	interval, err := parseSchedule(policy.Schedule)
+	if err != nil {
+		log.Errorf("volume '%v': %v", name, err)
+		return policy, false
+	}
+
+	last := state.LastScheduledSnapshot
+	if last.IsZero() {
+		last = state.CreatedAt
+	}
+	return policy, now.Sub(last) >= interval
+}
+
+// pruneSnapshots deletes the oldest scheduled snapshots of the volume until
+// at most keep of them are left. Snapshots taken on demand are never
+// deleted, and neither is anything that does not carry the driver's prefix.
+func (d *Driver) pruneSnapshots(name string, keep int) error {
+	defer d.locks.lock(name)()
+
+	state, ok := d.lookupVolume(name)
+	if !ok {
+		return fmt.Errorf("Volume %q does not exist", name)
+	}
+
+	scheduled := []SnapshotRecord{}
+	for _, snapshot := range state.Snapshots {
+		if snapshot.Scheduled && strings.HasPrefix(snapshot.Name, VolumeNamePrefix) {
+			scheduled = append(scheduled, snapshot)
+		}
+	}
+	if len(scheduled) <= keep {
+		return nil
+	}
+
+	sort.Sort(snapshotsByAge(scheduled))
+
+	expired := make(map[string]bool)
+	for _, snapshot := range scheduled[:len(scheduled)-keep] {
+		_, err := d.provider.DeleteSnapshot(snapshot.Id)
+		if err != nil && !isNotFound(err) {
+			log.Errorf("failed to delete snapshot '%v' of volume '%v': %v", snapshot.Id, name, err)
+			continue
+		}
+		log.Infof("deleted expired snapshot '%v' (%v) of volume '%v'", snapshot.Name, snapshot.Id, name)
+		expired[snapshot.Id] = true
+	}
+
+	snapshots := []SnapshotRecord{}
+	for _, snapshot := range state.Snapshots {
+		if !expired[snapshot.Id] {
+			snapshots = append(snapshots, snapshot)
+		}
+	}
+	state.Snapshots = snapshots
+
+	return d.saveVolumeState(state)
+}
+
+type snapshotsByAge []SnapshotRecord
+
+func (s snapshotsByAge) Len() int           { return len(s) }
+func (s snapshotsByAge) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s snapshotsByAge) Less(i, j int) bool { return s[i].CreatedAt.Before(s[j].CreatedAt) }
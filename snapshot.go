@@ -0,0 +1,274 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"time"
+)
+
+// SnapshotRecord describes a snapshot taken of a volume by the driver.
+type SnapshotRecord struct {
+	Id        string    `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"createdAt"`
+	Scheduled bool      `json:"scheduled,omitempty"`
+	// Pending is set until the snapshot is known to be done. It is kept
+	// if waiting for the snapshot failed, so that the snapshot is still
+	// pruned by the retention of scheduled snapshots.
+	Pending bool `json:"pending,omitempty"`
+}
+
+// Snapshot creates a ProfitBricks snapshot of the named Docker volume and
+// records it in the volume's metadata. If snapshotName is empty a name is
+// derived from the volume name and the current time.
+func (d *Driver) Snapshot(name string, snapshotName string) (*SnapshotRecord, error) {
+	return d.createSnapshot(name, snapshotName, false)
+}
+
+func (d *Driver) createSnapshot(name string, snapshotName string, scheduled bool) (*SnapshotRecord, error) {
+	defer d.locks.lock(name)()
+
+	state, ok := d.lookupVolume(name)
+	if !ok {
+		return nil, fmt.Errorf("Volume %q does not exist", name)
+	}
+	if err := state.checkProvisioned(); err != nil {
+		return nil, err
+	}
+	if err := state.checkIdle(); err != nil {
+		return nil, err
+	}
+
+	if snapshotName == "" {
+		snapshotName = fmt.Sprintf("%s%s-%s", VolumeNamePrefix, name, time.Now().UTC().Format("20060102-150405"))
+	}
+
+	var snapshot CloudSnapshot
+	var location string
+	datacenterId, volumeId := state.DatacenterId, state.VolumeId
+	err := d.waitUnlocked(state, "snapshot", func() error {
+		var err error
+		snapshot, location, err = d.provider.CreateSnapshot(datacenterId, volumeId, snapshotName)
+		if err != nil {
+			return fmt.Errorf("failed to create snapshot of volume '%v': %v", name, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// the snapshot is recorded as soon as it exists, before waiting for it
+	record := SnapshotRecord{
+		Id:        snapshot.Id,
+		Name:      snapshotName,
+		CreatedAt: time.Now().UTC(),
+		Scheduled: scheduled,
+		Pending:   true,
+	}
+	state.Snapshots = append(state.Snapshots, record)
+	if err := d.saveVolumeState(state); err != nil {
+		log.Error(err.Error())
+	}
+
+	err = d.waitUnlocked(state, "snapshot", func() error {
+		return d.provider.Wait(d.ctx, location)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range state.Snapshots {
+		if state.Snapshots[i].Id == record.Id {
+			state.Snapshots[i].Pending = false
+		}
+	}
+	record.Pending = false
+	if scheduled {
+		state.LastScheduledSnapshot = record.CreatedAt
+	}
+
+	err = d.saveVolumeState(state)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infof("created snapshot '%v' (%v) of volume '%v'", record.Name, record.Id, name)
+	return &record, nil
+}
+
+// Restore rolls the named volume back to one of its snapshots in place. The
+// volume must not be in use; it is detached, restored, attached again and
+// its filesystem is checked before it is handed back to Docker. Mounting
+// the volume fails until the restore is done.
+func (d *Driver) Restore(name string, snapshot string) (*VolumeState, error) {
+	defer d.locks.lock(name)()
+
+	state, ok := d.lookupVolume(name)
+	if !ok {
+		return nil, fmt.Errorf("Volume %q does not exist", name)
+	}
+	if err := state.checkProvisioned(); err != nil {
+		return nil, err
+	}
+	if err := state.checkIdle(); err != nil {
+		return nil, err
+	}
+
+	if len(state.Mounts) > 0 {
+		return nil, fmt.Errorf("Volume %q is still mounted by %d container(s)", name, len(state.Mounts))
+	}
+
+	snapshotId, snapshotSize, err := d.resolveVolumeSource(VolumeOptions{FromSnapshot: snapshot})
+	if err != nil {
+		return nil, err
+	}
+	if snapshotSize > state.Options.Size {
+		return nil, fmt.Errorf("snapshot '%v' of %d GB does not fit into volume '%v' of %d GB", snapshotId, snapshotSize, name, state.Options.Size)
+	}
+
+	err = d.restoreSnapshot(state, snapshotId)
+	state.recordEvent(OperationRestore, fmt.Sprintf("restored from snapshot '%v'", snapshotId), err)
+
+	if saveErr := d.saveVolumeState(state); saveErr != nil {
+		log.Error(saveErr.Error())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infof("restored volume '%v' from snapshot '%v'", name, snapshotId)
+	restored := *state
+	return &restored, nil
+}
+
+func (d *Driver) restoreSnapshot(state *VolumeState, snapshotId string) error {
+	mounted, err := d.utilities.IsMounted(state.MountPoint)
+	if err != nil {
+		return err
+	}
+	if mounted {
+		err = d.utilities.UnmountVolume(state.MountPoint)
+		if err != nil {
+			return fmt.Errorf("failed to unmount '%v': %v", state.MountPoint, err)
+		}
+	}
+
+	var vol CloudVolume
+	var attached bool
+	var attachErr error
+	datacenterId, serverId, volumeId := state.DatacenterId, state.ServerId, state.VolumeId
+	err = d.waitUnlocked(state, OperationRestore, func() error {
+		err := d.detachVolume(datacenterId, serverId, volumeId)
+		if err != nil {
+			return err
+		}
+
+		location, err := d.provider.RestoreSnapshot(datacenterId, volumeId, snapshotId)
+		if err != nil {
+			err = fmt.Errorf("failed to restore snapshot '%v': %v", snapshotId, err)
+		} else {
+			err = d.provider.Wait(d.ctx, location)
+		}
+
+		// the volume is attached again even if the restore failed, so that it
+		// stays usable in its previous state
+		vol, attachErr = d.attachVolume(datacenterId, serverId, volumeId)
+		attached = true
+		return err
+	})
+	if !attached {
+		return err
+	}
+	if attachErr == nil {
+		attachErr = d.resolveAttachedDevice(state, vol)
+	}
+	if err != nil {
+		if attachErr != nil {
+			log.Errorf("failed to attach volume '%v' again: %v", state.Name, attachErr)
+		}
+		return err
+	}
+	if attachErr != nil {
+		return attachErr
+	}
+
+	filesystem, err := d.utilities.GetFilesystem(state.DeviceName)
+	if err != nil {
+		return err
+	}
+	if filesystem == "" {
+		return fmt.Errorf("restored volume '%v' contains no filesystem", state.Name)
+	}
+	state.Filesystem = filesystem
+
+	return d.utilities.CheckFilesystem(state.DeviceName, filesystem)
+}
+
+// attachVolume attaches the volume to the server and returns it as
+// attached.
+func (d *Driver) attachVolume(datacenterId string, serverId string, volumeId string) (CloudVolume, error) {
+	location, err := d.provider.AttachVolume(datacenterId, serverId, volumeId)
+	if err != nil {
+		return CloudVolume{}, fmt.Errorf("failed to attach volume '%v': %v", volumeId, err)
+	}
+	err = d.provider.Wait(d.ctx, location)
+	if err != nil {
+		return CloudVolume{}, err
+	}
+
+	vol, err := d.provider.GetAttachedVolume(datacenterId, serverId, volumeId)
+	if err != nil {
+		return CloudVolume{}, fmt.Errorf("failed to get attached volume '%v': %v", volumeId, err)
+	}
+	return vol, nil
+}
+
+// resolveAttachedDevice updates the device the attached volume shows up as
+// in its record.
+func (d *Driver) resolveAttachedDevice(state *VolumeState, vol CloudVolume) error {
+	device, err := d.utilities.ResolveDevice(state.VolumeId, vol.DeviceNumber, vol.Bus, state.Options.Size, DeviceWaitTimeout)
+	if err != nil {
+		return err
+	}
+	d.refreshSize(state, device)
+	state.DeviceName = device
+	state.DeviceNumber = vol.DeviceNumber
+	return nil
+}
+
+// resolveVolumeSource looks up the snapshot, by ID or name, or the image a
+// new volume is created from and returns its ID and size in GB.
+func (d *Driver) resolveVolumeSource(opts VolumeOptions) (string, int, error) {
+	if opts.FromImage != "" {
+		image, err := d.provider.GetImage(opts.FromImage)
+		if err != nil {
+			return "", 0, fmt.Errorf("image '%v' not found: %v", opts.FromImage, err)
+		}
+		return image.Id, image.Size, nil
+	}
+
+	snapshots, err := d.provider.ListSnapshots()
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to list snapshots: %v", err)
+	}
+
+	var found []CloudSnapshot
+	for _, snapshot := range snapshots {
+		if snapshot.Id == opts.FromSnapshot {
+			return snapshot.Id, snapshot.Size, nil
+		}
+		if snapshot.Name == opts.FromSnapshot {
+			found = append(found, snapshot)
+		}
+	}
+
+	switch len(found) {
+	case 0:
+		return "", 0, fmt.Errorf("snapshot '%v' not found", opts.FromSnapshot)
+	case 1:
+		return found[0].Id, found[0].Size, nil
+	default:
+		return "", 0, fmt.Errorf("snapshot name '%v' is ambiguous, %d snapshots match, use the snapshot ID instead", opts.FromSnapshot, len(found))
+	}
+}
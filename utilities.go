@@ -2,72 +2,256 @@ package main
 
 import (
 	"bytes"
-	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os/exec"
+	"strings"
+	"syscall"
+	"time"
 )
 
+// HostUtilities is how the driver changes the host it runs on: it finds
+// the devices of attached volumes, creates and checks filesystems and
+// mounts them.
+type HostUtilities interface {
+	GetServerId() (string, error)
+
+	ResolveDevice(volumeId string, deviceNumber int64, bus string, sizeGB int, timeout time.Duration) (string, error)
+	ResolveMountedDevice(volumeId string, deviceNumber int64, bus string, mountPoint string) (string, error)
+	RescanDevice(device string, sizeGB int, timeout time.Duration) error
+	DeviceSize(device string) (int, error)
+
+	MountVolume(volumeName string, mountpoint string, filesystem string, mountOptions string) error
+	UnmountVolume(mountPoint string) error
+	IsMounted(mountPoint string) (bool, error)
+	FilesystemUsage(mountPoint string) (int, error)
+
+	FormatVolume(volumeName string, filesystem string, mkfsOptions string, force bool) error
+	GrowFilesystem(volumeName string, mountPoint string, filesystem string) error
+	CheckFilesystem(volumeName string, filesystem string) error
+	GetFilesystem(volumeName string) (string, error)
+}
+
+// CommandError is returned for commands that could not be started or
+// exited with a non-zero status. It carries what the command printed.
+type CommandError struct {
+	Command  string
+	ExitCode int
+	Stdout   string
+	Stderr   string
+	Err      error
+}
+
+func (e *CommandError) Error() string {
+	var msg string
+	if e.ExitCode < 0 {
+		msg = fmt.Sprintf("'%v' failed: %v", e.Command, e.Err)
+	} else {
+		msg = fmt.Sprintf("'%v' exited with status %d", e.Command, e.ExitCode)
+	}
+
+	output := strings.TrimSpace(e.Stderr)
+	if output == "" {
+		output = strings.TrimSpace(e.Stdout)
+	}
+	if output != "" {
+		msg += ": " + output
+	}
+	return msg
+}
+
+// CommandRunner runs a command on the host and returns its standard
+// output. Failures are returned as *CommandError.
+type CommandRunner func(name string, args ...string) (string, error)
+
+// RunCommand runs the command with exec.
+func RunCommand(name string, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	if err == nil {
+		return stdout.String(), nil
+	}
+
+	exitCode := -1
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			exitCode = status.ExitStatus()
+		}
+	}
+	return stdout.String(), &CommandError{
+		Command:  strings.Join(append([]string{name}, args...), " "),
+		ExitCode: exitCode,
+		Stdout:   stdout.String(),
+		Stderr:   stderr.String(),
+		Err:      err,
+	}
+}
+
+// exitCode returns the exit status of a command that failed with err, or
+// -1 if it did not run to completion.
+func exitCode(err error) int {
+	if cmdErr, ok := err.(*CommandError); ok {
+		return cmdErr.ExitCode
+	}
+	return -1
+}
+
+// Utilities implements HostUtilities with the usual Linux tools.
 type Utilities struct {
+	run CommandRunner
 }
 
 func NewUtilities() *Utilities {
-	return &Utilities{}
+	return NewUtilitiesWithRunner(RunCommand)
 }
 
-func (m Utilities) MountVolume(volumeName string, mountpoint string) error {
-	cmd := exec.Command("mount", volumeName, mountpoint)
-	return cmd.Run()
+func NewUtilitiesWithRunner(run CommandRunner) *Utilities {
+	return &Utilities{run: run}
 }
 
-func (m Utilities) UnmountVolume(mountPoint string) error {
-	cmd := exec.Command("umount", mountPoint)
-	return cmd.Run()
+func (m Utilities) MountVolume(volumeName string, mountpoint string, filesystem string, mountOptions string) error {
+	args := []string{"-t", filesystem}
+	if mountOptions != "" {
+		args = append(args, "-o", mountOptions)
+	}
+	_, err := m.run("mount", append(args, volumeName, mountpoint)...)
+	return err
 }
 
-func (m Utilities) FormatVolume(volumeName string) error {
-	cmd := exec.Command("mkfs.ext4", volumeName)
-	return cmd.Run()
+func (m Utilities) UnmountVolume(mountPoint string) error {
+	_, err := m.run("umount", mountPoint)
+	return err
 }
 
-func (m Utilities) GetServerId() (string, error) {
-	output, err := ioutil.ReadFile("/sys/devices/virtual/dmi/id/product_uuid")
+// IsMounted reports whether something is mounted on the given mount point.
+func (m Utilities) IsMounted(mountPoint string) (bool, error) {
+	mounts, err := ioutil.ReadFile("/proc/mounts")
+	if err != nil {
+		return false, err
+	}
 
-	return string(output), err
+	for _, line := range strings.Split(string(mounts), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 1 && fields[1] == mountPoint {
+			return true, nil
+		}
+	}
+	return false, nil
 }
 
-func (m Utilities) GetDeviceName() (string, error) {
-	deviceBaseName := "/dev/%s"
+// FilesystemUsage returns how much of the filesystem mounted on the mount
+// point is used, in percent of the space available to unprivileged users.
+func (m Utilities) FilesystemUsage(mountPoint string) (int, error) {
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(mountPoint, &stat)
+	if err != nil {
+		return 0, err
+	}
 
-	var stdOut, stdErr bytes.Buffer
-	cmd := exec.Command("lsblk", "-o", "MOUNTPOINT,NAME", "-J")
-	cmd.Stdout = &stdOut
-	cmd.Stderr = &stdErr
+	used := stat.Blocks - stat.Bfree
+	total := used + stat.Bavail
+	if total == 0 {
+		return 0, nil
+	}
+	return int(used * 100 / total), nil
+}
 
-	err := cmd.Run()
+// FormatVolume creates a filesystem on the device. With force set, mkfs is
+// told to overwrite an existing filesystem.
+func (m Utilities) FormatVolume(volumeName string, filesystem string, mkfsOptions string, force bool) error {
+	args := strings.Fields(mkfsOptions)
+	if force {
+		if filesystem == "ext4" {
+			args = append(args, "-F")
+		} else {
+			args = append(args, "-f")
+		}
+	}
+	_, err := m.run("mkfs."+filesystem, append(args, volumeName)...)
+	return err
+}
+
+// GrowFilesystem grows the filesystem on the device to the size of the
+// device. xfs and btrfs can only be grown while mounted, so they are
+// mounted on the mount point for the duration of the resize if needed.
+func (m Utilities) GrowFilesystem(volumeName string, mountPoint string, filesystem string) error {
+	mounted, err := m.IsMounted(mountPoint)
 	if err != nil {
-		return "", fmt.Errorf("Error: %s, %s", err.Error(), stdErr.String())
+		return err
 	}
 
-	resultObj := &Result{}
+	switch filesystem {
+	case "ext4":
+		if !mounted {
+			// resize2fs insists on a freshly checked filesystem when offline,
+			// e2fsck exits with 1 when it corrected errors
+			_, err = m.run("e2fsck", "-f", "-p", volumeName)
+			if err != nil && exitCode(err) != 1 {
+				return fmt.Errorf("failed to check '%v': %v", volumeName, err)
+			}
+		}
+		_, err = m.run("resize2fs", volumeName)
+		return err
+	case "xfs", "btrfs":
+		if !mounted {
+			err = m.MountVolume(volumeName, mountPoint, filesystem, "")
+			if err != nil {
+				return err
+			}
+			defer m.UnmountVolume(mountPoint)
+		}
+		if filesystem == "xfs" {
+			_, err = m.run("xfs_growfs", mountPoint)
+		} else {
+			_, err = m.run("btrfs", "filesystem", "resize", "max", mountPoint)
+		}
+		return err
+	default:
+		return fmt.Errorf("growing %v filesystems is not supported", filesystem)
+	}
+}
+
+// CheckFilesystem runs a read-only consistency check of the filesystem on
+// the device.
+func (m Utilities) CheckFilesystem(volumeName string, filesystem string) error {
+	var err error
+	switch filesystem {
+	case "ext4":
+		_, err = m.run("e2fsck", "-f", "-n", volumeName)
+	case "xfs":
+		_, err = m.run("xfs_repair", "-n", volumeName)
+	case "btrfs":
+		_, err = m.run("btrfs", "check", "--readonly", volumeName)
+	default:
+		return fmt.Errorf("checking %v filesystems is not supported", filesystem)
+	}
 
-	json.Unmarshal(stdOut.Bytes(), resultObj)
+	if err != nil {
+		return fmt.Errorf("the %v filesystem on '%v' is not consistent: %v", filesystem, volumeName, err)
+	}
+	return nil
+}
 
-	for _, b := range resultObj.Blockdevices {
-		if b.Mountpoint == "" && len(b.Children) == 0 {
-			return fmt.Sprintf(deviceBaseName, b.Name), nil
+// GetFilesystem probes the device with blkid and returns the type of the
+// filesystem found on it, or an empty string if there is none.
+func (m Utilities) GetFilesystem(volumeName string) (string, error) {
+	output, err := m.run("blkid", "-p", "-o", "value", "-s", "TYPE", volumeName)
+	if err != nil {
+		// blkid exits with 2 when no signature was found on the device
+		if exitCode(err) == 2 {
+			return "", nil
 		}
+		return "", fmt.Errorf("failed to probe '%v': %v", volumeName, err)
 	}
-	return "", err
+	return strings.TrimSpace(output), nil
 }
 
-type Result struct {
-	Blockdevices []struct {
-		Mountpoint string `json:"mountpoint"`
-		Name       string `json:"name"`
-		Children   []struct {
-			Mountpoint string `json:"mountpoint"`
-			Name       string `json:"name"`
-		} `json:"children,omitempty"`
-	} `json:"blockdevices"`
+func (m Utilities) GetServerId() (string, error) {
+	output, err := ioutil.ReadFile("/sys/devices/virtual/dmi/id/product_uuid")
+
+	return strings.TrimSpace(string(output)), err
 }
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// step is a command a script expects and how it answers it. Commands with
+// a non-zero exit status fail with a *CommandError.
+type step struct {
+	command string
+	stdout  string
+	exit    int
+}
+
+// script is a CommandRunner that expects its steps to run in order and
+// records the commands that were run.
+type script struct {
+	steps []step
+	ran   []string
+}
+
+func (s *script) run(name string, args ...string) (string, error) {
+	command := strings.Join(append([]string{name}, args...), " ")
+	s.ran = append(s.ran, command)
+
+	if len(s.ran) > len(s.steps) {
+		return "", &CommandError{Command: command, ExitCode: -1, Err: fmt.Errorf("unexpected command")}
+	}
+	step := s.steps[len(s.ran)-1]
+	if step.command != command {
+		return "", &CommandError{Command: command, ExitCode: -1, Err: fmt.Errorf("expected '%v'", step.command)}
+	}
+	if step.exit != 0 {
+		return step.stdout, &CommandError{Command: command, ExitCode: step.exit, Stderr: "failed", Err: fmt.Errorf("exit status %d", step.exit)}
+	}
+	return step.stdout, nil
+}
+
+func (s *script) check(t *testing.T) {
+	t.Helper()
+
+	expected := []string{}
+	for _, step := range s.steps {
+		expected = append(expected, step.command)
+	}
+	ran := append([]string{}, s.ran...)
+	if !reflect.DeepEqual(ran, expected) {
+		t.Errorf("ran %q, want %q", ran, expected)
+	}
+}
+
+func TestFormatVolume(t *testing.T) {
+	tests := []struct {
+		name        string
+		filesystem  string
+		mkfsOptions string
+		force       bool
+		steps       []step
+		fails       bool
+	}{
+		{
+			name:       "ext4",
+			filesystem: "ext4",
+			steps:      []step{{command: "mkfs.ext4 /dev/vdb"}},
+		},
+		{
+			name:        "ext4 with options, forced",
+			filesystem:  "ext4",
+			mkfsOptions: "-L data  -m 0",
+			force:       true,
+			steps:       []step{{command: "mkfs.ext4 -L data -m 0 -F /dev/vdb"}},
+		},
+		{
+			name:       "xfs forced",
+			filesystem: "xfs",
+			force:      true,
+			steps:      []step{{command: "mkfs.xfs -f /dev/vdb"}},
+		},
+		{
+			name:       "btrfs forced",
+			filesystem: "btrfs",
+			force:      true,
+			steps:      []step{{command: "mkfs.btrfs -f /dev/vdb"}},
+		},
+		{
+			name:       "mkfs fails",
+			filesystem: "ext4",
+			steps:      []step{{command: "mkfs.ext4 /dev/vdb", exit: 1}},
+			fails:      true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := &script{steps: test.steps}
+			err := NewUtilitiesWithRunner(s.run).FormatVolume("/dev/vdb", test.filesystem, test.mkfsOptions, test.force)
+			if (err != nil) != test.fails {
+				t.Errorf("FormatVolume returned %v, want failure %v", err, test.fails)
+			}
+			s.check(t)
+		})
+	}
+}
+
+func TestGrowFilesystem(t *testing.T) {
+	// nothing is mounted on a new directory and / is always mounted
+	unmounted := t.TempDir()
+	mounted := "/"
+
+	tests := []struct {
+		name       string
+		filesystem string
+		mountPoint string
+		steps      []step
+		fails      bool
+	}{
+		{
+			name:       "ext4 offline",
+			filesystem: "ext4",
+			mountPoint: unmounted,
+			steps: []step{
+				{command: "e2fsck -f -p /dev/vdb"},
+				{command: "resize2fs /dev/vdb"},
+			},
+		},
+		{
+			name:       "ext4 offline with corrected errors",
+			filesystem: "ext4",
+			mountPoint: unmounted,
+			steps: []step{
+				{command: "e2fsck -f -p /dev/vdb", exit: 1},
+				{command: "resize2fs /dev/vdb"},
+			},
+		},
+		{
+			name:       "ext4 offline with uncorrected errors",
+			filesystem: "ext4",
+			mountPoint: unmounted,
+			steps:      []step{{command: "e2fsck -f -p /dev/vdb", exit: 4}},
+			fails:      true,
+		},
+		{
+			name:       "ext4 online",
+			filesystem: "ext4",
+			mountPoint: mounted,
+			steps:      []step{{command: "resize2fs /dev/vdb"}},
+		},
+		{
+			name:       "xfs offline",
+			filesystem: "xfs",
+			mountPoint: unmounted,
+			steps: []step{
+				{command: "mount -t xfs /dev/vdb " + unmounted},
+				{command: "xfs_growfs " + unmounted},
+				{command: "umount " + unmounted},
+			},
+		},
+		{
+			name:       "xfs online",
+			filesystem: "xfs",
+			mountPoint: mounted,
+			steps:      []step{{command: "xfs_growfs /"}},
+		},
+		{
+			name:       "xfs offline fails to grow",
+			filesystem: "xfs",
+			mountPoint: unmounted,
+			steps: []step{
+				{command: "mount -t xfs /dev/vdb " + unmounted},
+				{command: "xfs_growfs " + unmounted, exit: 1},
+				{command: "umount " + unmounted},
+			},
+			fails: true,
+		},
+		{
+			name:       "btrfs offline",
+			filesystem: "btrfs",
+			mountPoint: unmounted,
+			steps: []step{
+				{command: "mount -t btrfs /dev/vdb " + unmounted},
+				{command: "btrfs filesystem resize max " + unmounted},
+				{command: "umount " + unmounted},
+			},
+		},
+		{
+			name:       "unsupported filesystem",
+			filesystem: "vfat",
+			mountPoint: unmounted,
+			fails:      true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := &script{steps: test.steps}
+			err := NewUtilitiesWithRunner(s.run).GrowFilesystem("/dev/vdb", test.mountPoint, test.filesystem)
+			if (err != nil) != test.fails {
+				t.Errorf("GrowFilesystem returned %v, want failure %v", err, test.fails)
+			}
+			s.check(t)
+		})
+	}
+}
+
+func TestGetFilesystem(t *testing.T) {
+	tests := []struct {
+		name       string
+		step       step
+		filesystem string
+		fails      bool
+	}{
+		{name: "filesystem", step: step{stdout: "xfs\n"}, filesystem: "xfs"},
+		{name: "no filesystem", step: step{exit: 2}},
+		{name: "blkid fails", step: step{exit: 4}, fails: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.step.command = "blkid -p -o value -s TYPE /dev/vdb"
+			s := &script{steps: []step{test.step}}
+			filesystem, err := NewUtilitiesWithRunner(s.run).GetFilesystem("/dev/vdb")
+			if (err != nil) != test.fails {
+				t.Errorf("GetFilesystem returned %v, want failure %v", err, test.fails)
+			}
+			if filesystem != test.filesystem {
+				t.Errorf("GetFilesystem returned %q, want %q", filesystem, test.filesystem)
+			}
+			s.check(t)
+		})
+	}
+}
+
+func TestRescanDevice(t *testing.T) {
+	tests := []struct {
+		name    string
+		sizeGB  int
+		scsi    bool
+		fails   bool
+		rescans bool
+	}{
+		{name: "virtio grown", sizeGB: 10},
+		{name: "virtio grown beyond the size", sizeGB: 20},
+		{name: "virtio not grown", sizeGB: 5, fails: true},
+		{name: "scsi grown", sizeGB: 10, scsi: true, rescans: true},
+		{name: "scsi not grown", sizeGB: 5, scsi: true, fails: true, rescans: true},
+	}
+
+	sysBlockPath := SysBlockPath
+	defer func() { SysBlockPath = sysBlockPath }()
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			SysBlockPath = t.TempDir()
+			device := filepath.Join(SysBlockPath, "vdb")
+			rescan := filepath.Join(device, "device", "rescan")
+
+			err := os.MkdirAll(filepath.Dir(rescan), 0755)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.scsi {
+				err = ioutil.WriteFile(rescan, nil, 0600)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			sectors := fmt.Sprintf("%d\n", int64(test.sizeGB)<<30/512)
+			err = ioutil.WriteFile(filepath.Join(device, "size"), []byte(sectors), 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = NewUtilitiesWithRunner(nil).RescanDevice("/dev/vdb", 10, 0)
+			if (err != nil) != test.fails {
+				t.Errorf("RescanDevice returned %v, want failure %v", err, test.fails)
+			}
+
+			written, _ := ioutil.ReadFile(rescan)
+			if rescanned := string(written) == "1"; rescanned != test.rescans {
+				t.Errorf("device rescanned: %v, want %v", rescanned, test.rescans)
+			}
+		})
+	}
+}